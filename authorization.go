@@ -0,0 +1,517 @@
+package digestRequest
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const cnonce = "cnonce"
+const nc = "nc"
+const response = "response"
+const rspauth = "rspauth"
+const uri = "uri"
+const username = "username"
+
+// selectQop picks the qop to answer with from the list the server offered,
+// which may have spaces around the tokens as in "auth, auth-int"
+func (r *DigestRequest) selectQop(offered string) (string, error) {
+	tokens := qopTokens(offered)
+	has := func(qop string) bool { return contains(tokens, qop) }
+
+	if r.preferredQop != "" {
+		if has(r.preferredQop) {
+			return r.preferredQop, nil
+		}
+		if r.strictQop {
+			return "", fmt.Errorf("server does not offer qop %s: %s", r.preferredQop, offered)
+		}
+	}
+	if has(qopAuth) {
+		return qopAuth, nil
+	}
+	if has(qopAuthInt) {
+		return qopAuthInt, nil
+	}
+	if len(tokens) == 0 {
+		return "", fmt.Errorf("server offers no qop: %s", offered)
+	}
+	return tokens[0], nil
+}
+
+// checkQop makes sure q, the qop about to be sent, is one the server offered
+// and one that can be answered, whatever chose it. An empty q answers as in
+// RFC 2069, which needs no offer.
+func checkQop(q, offered string) error {
+	if q == "" {
+		return nil
+	}
+	if q != qopAuth && q != qopAuthInt {
+		return fmt.Errorf("unsupported qop: %s", q)
+	}
+	if !contains(qopTokens(offered), q) {
+		return fmt.Errorf("qop %s is not offered by the server: %s", q, offered)
+	}
+	return nil
+}
+
+// hashAlgorithm is a hash function of an algorithm, with a pool of hashers
+// and buffers to join the parts in
+type hashAlgorithm struct {
+	name string
+	new  func() hash.Hash
+	pool sync.Pool
+}
+
+type hasher struct {
+	hash hash.Hash
+	buf  []byte
+}
+
+var (
+	md5Algorithm       = &hashAlgorithm{name: algorithmMD5, new: md5.New}
+	sha256Algorithm    = &hashAlgorithm{name: algorithmSHA256, new: sha256.New}
+	sha512256Algorithm = &hashAlgorithm{name: algorithmSHA512256, new: sha512.New512_256}
+)
+
+// hashAlgorithms are the supported algorithms
+var hashAlgorithms = []*hashAlgorithm{md5Algorithm, sha256Algorithm, sha512256Algorithm}
+
+// lookupAlgorithm returns the algorithm named name, whatever its case, MD5
+// when it is empty, or nil when it is not supported
+func lookupAlgorithm(name string) *hashAlgorithm {
+	if name == "" {
+		return md5Algorithm
+	}
+	for _, a := range hashAlgorithms {
+		if strings.EqualFold(a.name, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+// qopTokens splits a qop list into its tokens without spaces or empty ones
+func qopTokens(offered string) []string {
+	var tokens []string
+	for _, t := range strings.Split(offered, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens
+}
+
+// sum returns the hex hash of texts joined with ":". It reuses a pooled
+// hasher and buffer to keep allocations down in the hot path.
+func (a *hashAlgorithm) sum(texts []string) string {
+	h, ok := a.pool.Get().(*hasher)
+	if !ok {
+		h = &hasher{hash: a.new()}
+	}
+	h.buf = h.buf[:0]
+	for i, t := range texts {
+		if i > 0 {
+			h.buf = append(h.buf, ':')
+		}
+		h.buf = append(h.buf, t...)
+	}
+	h.hash.Reset()
+	_, _ = h.hash.Write(h.buf)
+
+	var sum [sha256.Size]byte
+	var encoded [sha256.Size * 2]byte
+	n := hex.Encode(encoded[:], h.hash.Sum(sum[:0]))
+	a.pool.Put(h)
+	return string(encoded[:n])
+}
+
+// ha1Cache keeps the last HA1, which only changes with the credentials, the
+// realm or the algorithm. A session algorithm folds the cnonce into HA1, so
+// it must not be served from here.
+type ha1Cache struct {
+	mu                        sync.Mutex
+	alg                       *hashAlgorithm
+	username, realm, password string
+	ha1                       string
+}
+
+func (c *ha1Cache) get(alg *hashAlgorithm, username, realm, password string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ha1 == "" || c.alg != alg || c.username != username || c.realm != realm || c.password != password {
+		c.alg, c.username, c.realm, c.password = alg, username, realm, password
+		c.ha1 = alg.sum([]string{username, realm, password})
+	}
+	return c.ha1
+}
+
+func (c *ha1Cache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ha1 = ""
+}
+
+// digestURI returns the uri directive for req. It is the absolute URL unless
+// WithIISCompat asks for the request-target as sent on the request line.
+//
+// CONNECT requests to open a tunnel through a proxy have the authority, such
+// as "example.com:443", as their request-target, which is taken the same way
+// http.Request.Write does.
+func (r *DigestRequest) digestURI(req *http.Request) string {
+	if req.Method == http.MethodConnect && req.URL.Path == "" {
+		if req.URL.Opaque != "" {
+			return req.URL.Opaque
+		}
+		if req.Host != "" {
+			return req.Host
+		}
+		return req.URL.Host
+	}
+	if r.originFormURI {
+		return req.URL.RequestURI()
+	}
+	return req.URL.String()
+}
+
+// credentials are the username and password to answer a challenge with
+type credentials struct {
+	username, password string
+}
+
+// String keeps the password out of anything credentials are formatted into
+func (c credentials) String() string {
+	return fmt.Sprintf("{username:%s password:%s}", c.username, redact(c.password))
+}
+
+func (c credentials) GoString() string {
+	return c.String()
+}
+
+// credentialsFor returns the credentials to answer c with: those of
+// WithCredentialProvider for its realm if it is set, else given. ok is false
+// when the provider has none.
+func (r *DigestRequest) credentialsFor(c *Challenge, given credentials) (credentials, bool) {
+	if r.credentialProvider == nil {
+		return given, true
+	}
+	username, password, ok := r.credentialProvider(unquote(c.Realm))
+	return credentials{username, password}, ok
+}
+
+// newCnonce returns 16 hex digits read from WithRandom, or crypto/rand
+func (r *DigestRequest) newCnonce() (string, error) {
+	random := r.random
+	if random == nil {
+		random = rand.Reader
+	}
+	b := make([]byte, 8)
+	r.randomMu.Lock()
+	_, err := io.ReadFull(random, b)
+	r.randomMu.Unlock()
+	if err != nil {
+		return "", fmt.Errorf("cannot generate cnonce: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// answer is what an Authorization was computed from, kept to check the
+// rspauth of the server against
+type answer struct {
+	alg                              *hashAlgorithm
+	ha1, nonce, nc, cnonce, qop, uri string
+}
+
+func (r *DigestRequest) makeAuthorization(req *http.Request, c *Challenge, count string, cred credentials) (string, *answer, error) {
+	// a challenge without qop is answered as in RFC 2069
+	var q string
+	if c.Qop != "" || r.strictQop && r.preferredQop != "" {
+		var err error
+		if q, err = r.selectQop(c.Qop); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := checkQop(q, c.Qop); err != nil {
+		return "", nil, err
+	}
+	// nc is hashed as it is sent, so the server gets the same either way
+	if r.uppercaseNC {
+		count = strings.ToUpper(count)
+	}
+
+	alg := lookupAlgorithm(c.Algorithm)
+	p := AuthorizationParams{
+		// HA2 has the method of req itself, whatever the probe was sent with
+		Method:    req.Method,
+		URI:       r.digestURI(req),
+		Challenge: c,
+		Username:  cred.username,
+		Password:  cred.password,
+		Qop:       q,
+	}
+	if q == qopAuthInt {
+		var err error
+		if p.BodyHash, err = r.hashBody(req, alg); err != nil {
+			return "", nil, err
+		}
+	}
+	// the legacy response has no cnonce, so none is generated for it
+	if q != "" {
+		var err error
+		if p.Cnonce, err = r.newCnonce(); err != nil {
+			return "", nil, err
+		}
+	}
+	ha1 := r.ha1.get(alg, cred.username, unquote(c.Realm), cred.password)
+	directives, a := authorizationDirectives(p, alg, count, ha1, r.respond)
+	// noncompliant servers may want the quoting otherwise
+	for i := range directives {
+		switch directives[i].name {
+		case uri:
+			directives[i].quoted = !r.unquotedURI
+		case nc:
+			directives[i].quoted = r.quotedNC
+		}
+	}
+	return formatAuthorization(directives, r.directiveOrder), a, nil
+}
+
+// AuthorizationParams is everything an Authorization is built from by
+// BuildAuthorization
+type AuthorizationParams struct {
+	// Method and URI are those of the request, URI as in the uri directive
+	Method, URI string
+	// Challenge is the challenge answered. Its algorithm, and userhash, are
+	// used too.
+	Challenge          *Challenge
+	Username, Password string
+	// Qop is the qop answered with: "auth", "auth-int", or empty to answer
+	// as in RFC 2069
+	Qop string
+	// NC is the nonce count and Cnonce the client nonce, which are required
+	// with a qop
+	NC     int
+	Cnonce string
+	// BodyHash is the hash of the body for auth-int, as BodyHash returns it
+	// for the algorithm of Challenge. It is that of an empty body when it is
+	// empty.
+	BodyHash string
+}
+
+// BuildAuthorization returns the Authorization header answering p, as Do
+// would send it if it generated the cnonce and nc of p. It sends nothing.
+func BuildAuthorization(p AuthorizationParams) (string, error) {
+	c := p.Challenge
+	if c == nil {
+		return "", fmt.Errorf("no challenge to answer")
+	}
+	if err := c.validate(); err != nil {
+		return "", err
+	}
+	switch p.Qop {
+	case "":
+	case qopAuth, qopAuthInt:
+		if p.Cnonce == "" || p.NC <= 0 {
+			return "", fmt.Errorf("qop %s needs a cnonce and nc", p.Qop)
+		}
+		if int64(p.NC) > maxNonceCount {
+			return "", fmt.Errorf("nc is over 8 hex digits: %d", p.NC)
+		}
+	default:
+		return "", fmt.Errorf("unsupported qop: %s", p.Qop)
+	}
+	alg := lookupAlgorithm(c.Algorithm)
+	if p.Qop == qopAuthInt && p.BodyHash == "" {
+		p.BodyHash = alg.sum([]string{""})
+	}
+	ha1 := alg.sum([]string{p.Username, unquote(c.Realm), p.Password})
+	directives, _ := authorizationDirectives(p, alg, nonceCount(p.NC).String(), ha1, nil)
+	return formatAuthorization(directives, nil), nil
+}
+
+// ResponseInput is what the response directive is computed from, for
+// WithResponseFunc
+type ResponseInput struct {
+	// Algorithm is the name of the algorithm, such as "MD5"
+	Algorithm string
+	// HA1 and HA2 are hashed already, HA2 with the BodyHash for auth-int
+	HA1, HA2               string
+	Method, URI            string
+	Username, Realm, Nonce string
+	NC, Cnonce, Qop        string
+	BodyHash               string
+	// Hash returns the hex hash of parts joined with ":" with the algorithm
+	Hash func(parts ...string) string
+}
+
+// Response computes the response directive as RFC 7616 does, or RFC 2069
+// without a qop
+func Response(in ResponseInput) string {
+	if in.Qop == "" {
+		return in.Hash(in.HA1, in.Nonce, in.HA2)
+	}
+	return in.Hash(in.HA1, in.Nonce, in.NC, in.Cnonce, in.Qop, in.HA2)
+}
+
+// authorizationDirectives computes the response to p with alg and ha1, by
+// respond unless it is nil, and returns the directives of the Authorization,
+// with count as nc
+func authorizationDirectives(p AuthorizationParams, alg *hashAlgorithm, count, ha1 string, respond func(ResponseInput) string) ([]directive, *answer) {
+	c := p.Challenge
+	ha2 := alg.sum([]string{p.Method, p.URI})
+	if p.Qop == qopAuthInt {
+		ha2 = alg.sum([]string{p.Method, p.URI, p.BodyHash})
+	}
+	in := ResponseInput{
+		Algorithm: alg.name,
+		HA1:       ha1,
+		HA2:       ha2,
+		Method:    p.Method,
+		URI:       p.URI,
+		Username:  p.Username,
+		Realm:     unquote(c.Realm),
+		Nonce:     unquote(c.Nonce),
+		NC:        count,
+		Cnonce:    p.Cnonce,
+		Qop:       p.Qop,
+		BodyHash:  p.BodyHash,
+		Hash:      func(parts ...string) string { return alg.sum(parts) },
+	}
+	if respond == nil {
+		respond = Response
+	}
+	resp := respond(in)
+	// HA1 joins the username with ":" as it is, which the server does too.
+	// A server offering userhash takes the username hashed, so that one
+	// with a colon is not ambiguous on the wire either.
+	name := p.Username
+	if c.Userhash {
+		name = alg.sum([]string{p.Username, unquote(c.Realm)})
+	}
+	directives := []directive{
+		{name: username, value: name, quoted: true},
+		{name: realm, value: c.Realm, quoted: true},
+		{name: nonce, value: c.Nonce, quoted: true},
+		{name: uri, value: p.URI, quoted: true},
+	}
+	if p.Qop != "" {
+		directives = append(directives,
+			directive{name: qop, value: p.Qop},
+			directive{name: nc, value: count},
+			directive{name: cnonce, value: p.Cnonce, quoted: true},
+		)
+	}
+	directives = append(directives, directive{name: response, value: resp, quoted: true})
+	if c.Opaque != "" {
+		directives = append(directives, directive{name: opaque, value: c.Opaque, quoted: true})
+	}
+	// the algorithm must be echoed when the server named one
+	if c.Algorithm != "" {
+		directives = append(directives, directive{name: algorithm, value: c.Algorithm})
+	}
+	if c.Userhash {
+		directives = append(directives, directive{name: userhash, value: "true"})
+	}
+	a := &answer{
+		alg:    alg,
+		ha1:    ha1,
+		nonce:  unquote(c.Nonce),
+		nc:     count,
+		cnonce: p.Cnonce,
+		qop:    p.Qop,
+		uri:    p.URI,
+	}
+	return directives, a
+}
+
+// checkResponseAuth verifies the rspauth in the Authentication-Info of resp,
+// with which the server proves it knows the password too. A response
+// without one is accepted. For auth-int the rspauth covers the body of the
+// response, which is not read here, so it is not checked, and RFC 2069 has
+// no rspauth at all.
+//
+// WithStrictAuthenticationInfo checks the qop, cnonce and nc echoed as well.
+func (r *DigestRequest) checkResponseAuth(resp *http.Response, a *answer) error {
+	info := resp.Header.Get(authenticationInfo)
+	if info == "" || a.qop == "" {
+		return nil
+	}
+	for _, d := range splitDirectives(info) {
+		k, v := splitDirective(d)
+		switch k {
+		case rspauth:
+			if a.qop == qopAuthInt {
+				continue
+			}
+			ha2 := a.alg.sum([]string{"", a.uri})
+			expected := a.alg.sum([]string{a.ha1, a.nonce, a.nc, a.cnonce, a.qop, ha2})
+			// compare in constant time so as not to leak how much of it matched
+			if subtle.ConstantTimeCompare([]byte(v), []byte(expected)) != 1 {
+				return ErrInvalidResponseAuth
+			}
+		case qop, cnonce, nc:
+			if !r.strictAuthInfo {
+				continue
+			}
+			sent := map[string]string{qop: a.qop, cnonce: a.cnonce, nc: a.nc}[k]
+			// nc is hex, which the server may write in another case
+			if v != sent && !(k == nc && strings.EqualFold(v, sent)) {
+				return &ResponseAuthError{Directive: k, Sent: sent, Received: v}
+			}
+		}
+	}
+	return nil
+}
+
+// directive is a name=value pair in the Authorization header
+type directive struct {
+	name, value string
+	quoted      bool
+}
+
+// formatAuthorization joins directives into the Authorization header. The
+// names in order come first in that order, and the rest follow as given.
+func formatAuthorization(directives []directive, order []string) string {
+	sorted := make([]directive, 0, len(directives))
+	for _, name := range order {
+		for _, d := range directives {
+			if d.name == name {
+				sorted = append(sorted, d)
+			}
+		}
+	}
+	for _, d := range directives {
+		if !contains(order, d.name) {
+			sorted = append(sorted, d)
+		}
+	}
+
+	parts := make([]string, len(sorted))
+	for i, d := range sorted {
+		if d.quoted {
+			parts[i] = fmt.Sprintf(`%s="%s"`, d.name, d.value)
+		} else {
+			parts[i] = fmt.Sprintf(`%s=%s`, d.name, d.value)
+		}
+	}
+	return "Digest " + strings.Join(parts, ", ")
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package digestRequest
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+var testDirectives = []directive{
+	{name: username, value: "john", quoted: true},
+	{name: realm, value: "example.com", quoted: true},
+	{name: qop, value: "auth"},
+	{name: response, value: "abc", quoted: true},
+}
+
+func TestFormatAuthorization(t *testing.T) {
+	expected := `Digest username="john", realm="example.com", qop=auth, response="abc"`
+	if a := formatAuthorization(testDirectives, nil); a != expected {
+		t.Errorf("invalid header: %s", a)
+	}
+}
+
+func TestFormatAuthorizationWithOrder(t *testing.T) {
+	expected := `Digest response="abc", username="john", realm="example.com", qop=auth`
+	if a := formatAuthorization(testDirectives, []string{response, username}); a != expected {
+		t.Errorf("invalid header: %s", a)
+	}
+}
+
+func TestHA1Cache(t *testing.T) {
+	var c ha1Cache
+	if ha1 := c.get(md5Algorithm, "john", "example.com", "hello"); ha1 != "b98e16cbc3d01734b264adba7baa3bf9" {
+		t.Errorf("invalid HA1: %s", ha1)
+	}
+	if ha1 := c.get(md5Algorithm, "john", "example.com", "hello"); ha1 != "b98e16cbc3d01734b264adba7baa3bf9" {
+		t.Errorf("invalid cached HA1: %s", ha1)
+	}
+	if ha1 := c.get(md5Algorithm, "john", "example.org", "hello"); ha1 == "b98e16cbc3d01734b264adba7baa3bf9" {
+		t.Errorf("HA1 is not recomputed for another realm")
+	}
+	if ha1 := c.get(sha256Algorithm, "john", "example.org", "hello"); len(ha1) != 64 {
+		t.Errorf("HA1 is not recomputed for another algorithm: %s", ha1)
+	}
+}
+
+func benchmarkMakeAuthorization(b *testing.B, reset bool, qop string) {
+	r := New(context.Background(), "john", "hello")
+	c := &Challenge{Realm: "example.com", Nonce: "abc", Opaque: "def", Qop: qop}
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		b.Fatalf("error in NewRequest: %v", err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if reset {
+			r.ha1 = ha1Cache{}
+		}
+		if _, _, err := r.makeAuthorization(req, c, "00000001", credentials{"john", "hello"}); err != nil {
+			b.Fatalf("error in makeAuthorization: %v", err)
+		}
+	}
+}
+
+func BenchmarkMakeAuthorization(b *testing.B) {
+	benchmarkMakeAuthorization(b, false, "auth")
+}
+
+func BenchmarkMakeAuthorizationWithoutHA1Cache(b *testing.B) {
+	benchmarkMakeAuthorization(b, true, "auth")
+}
+
+func BenchmarkMakeAuthorizationLegacy(b *testing.B) {
+	benchmarkMakeAuthorization(b, false, "")
+}
+
+func BenchmarkMD5Sum(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		md5Algorithm.sum([]string{"b98e16cbc3d01734b264adba7baa3bf9", "dcd98b7102dd2f0e8b11d0f600bfb0c093", "00000001", "0a4f113b", "auth", "39aff3a2bab6126f332b942af96d3366"})
+	}
+}
+
+func TestSelectQop(t *testing.T) {
+	for _, c := range []struct {
+		offered, preferred, expected string
+	}{
+		{"auth,auth-int", "", "auth"},
+		{"auth, auth-int", "", "auth"},
+		{" auth-int , auth ", "", "auth"},
+		{"auth, auth-int", "auth-int", "auth-int"},
+		{"auth-int, auth", "auth-int", "auth-int"},
+		{"auth-int", "", "auth-int"},
+		{"auth-conf, auth-int", "", "auth-int"},
+	} {
+		r := New(context.Background(), "john", "hello", WithPreferredQop(c.preferred))
+		q, err := r.selectQop(c.offered)
+		if err != nil {
+			t.Errorf("error in selectQop(%q): %v", c.offered, err)
+		} else if q != c.expected {
+			t.Errorf("selectQop(%q) with %q: %s", c.offered, c.preferred, q)
+		}
+	}
+
+	if _, err := New(context.Background(), "john", "hello").selectQop(" , "); err == nil {
+		t.Errorf("no error for an empty qop list")
+	}
+}
+
+func TestCheckQop(t *testing.T) {
+	for _, tc := range []struct {
+		q, offered, err string
+	}{
+		{"auth", "auth,auth-int", ""},
+		{"auth-int", " auth-int ", ""},
+		{"", "", ""},
+		{"auth-int", "auth", "qop auth-int is not offered by the server: auth"},
+		{"auth", "", "qop auth is not offered by the server: "},
+		{"auth-conf", "auth-conf", "unsupported qop: auth-conf"},
+	} {
+		err := checkQop(tc.q, tc.offered)
+		if tc.err == "" && err != nil || tc.err != "" && (err == nil || err.Error() != tc.err) {
+			t.Errorf("invalid error for %q of %q: %v", tc.q, tc.offered, err)
+		}
+	}
+
+	// a qop the server offers but which cannot be answered is refused
+	// before anything is sent with it
+	r := New(context.Background(), "john", "hello", WithPreferredQop("auth-conf"))
+	req, err := http.NewRequest("GET", "http://example.com/", nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	c := &Challenge{Realm: "example.com", Nonce: "abc", Opaque: "def", Qop: "auth-conf"}
+	if _, _, err := r.makeAuthorization(req, c, "00000001", credentials{"john", "hello"}); err == nil || !strings.Contains(err.Error(), "unsupported qop") {
+		t.Errorf("invalid error: %v", err)
+	}
+}
+
+func TestLegacyAuthorization(t *testing.T) {
+	r := New(context.Background(), "Mufasa", "CircleOfLife")
+	// the example of RFC 2069, with its opaque
+	c := &Challenge{Realm: "testrealm@host.com", Nonce: "dcd98b7102dd2f0e8b11d0f600bfb0c093", Opaque: "5ccc069c403ebaf9f0171e9517f40e41"}
+	req, err := http.NewRequest("GET", "http://www.nowhere.org/dir/index.html", nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	r.originFormURI = true
+	auth, a, err := r.makeAuthorization(req, c, "00000001", credentials{"Mufasa", "CircleOfLife"})
+	if err != nil {
+		t.Fatalf("error in makeAuthorization: %v", err)
+	}
+	if !strings.Contains(auth, `response="1949323746fe6a43ef61f9606e7febea"`) {
+		t.Errorf("invalid response: %s", auth)
+	}
+	if strings.Contains(auth, "qop=") || strings.Contains(auth, "nc=") || strings.Contains(auth, "cnonce=") || a.cnonce != "" {
+		t.Errorf("legacy authorization has qop directives: %s", auth)
+	}
+}
+
+func TestBuildAuthorization(t *testing.T) {
+	// the example of RFC 2617 3.5
+	c := &Challenge{
+		Realm:  "testrealm@host.com",
+		Nonce:  "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		Opaque: "5ccc069c403ebaf9f0171e9517f40e41",
+		Qop:    "auth,auth-int",
+	}
+	p := AuthorizationParams{
+		Method:    "GET",
+		URI:       "/dir/index.html",
+		Challenge: c,
+		Username:  "Mufasa",
+		Password:  "Circle Of Life",
+		Qop:       "auth",
+		NC:        1,
+		Cnonce:    "0a4f113b",
+	}
+	expected := `Digest username="Mufasa", realm="testrealm@host.com", ` +
+		`nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", uri="/dir/index.html", ` +
+		`qop=auth, nc=00000001, cnonce="0a4f113b", ` +
+		`response="6629fae49393a05397450978507c4ef1", opaque="5ccc069c403ebaf9f0171e9517f40e41"`
+	if a, err := BuildAuthorization(p); err != nil || a != expected {
+		t.Errorf("invalid header: %s, %v", a, err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		p    func(p *AuthorizationParams)
+		err  string
+	}{
+		{"no challenge", func(p *AuthorizationParams) { p.Challenge = nil }, "no challenge"},
+		{"no cnonce", func(p *AuthorizationParams) { p.Cnonce = "" }, "needs a cnonce"},
+		{"no nc", func(p *AuthorizationParams) { p.NC = 0 }, "needs a cnonce"},
+		{"unknown qop", func(p *AuthorizationParams) { p.Qop = "auth-conf" }, "unsupported qop"},
+	} {
+		q := p
+		tc.p(&q)
+		if _, err := BuildAuthorization(q); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("invalid error for %s: %v", tc.name, err)
+		}
+	}
+}
+
+func TestBuildAuthorizationMatchesDo(t *testing.T) {
+	var sent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sent = r.Header.Get(authorization); sent == "" {
+			w.Header().Set(wwwAuthenticate, `Digest realm="example.com", nonce="abc", opaque="def", qop="auth-int", algorithm=MD5, userhash=true`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("PUT", ts.URL+"/a", strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	r := New(context.Background(), "john", "hello")
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	params := parseAuthorization(sent)
+	a, err := BuildAuthorization(AuthorizationParams{
+		Method:    "PUT",
+		URI:       params["uri"],
+		Challenge: r.LastChallenge(),
+		Username:  "john",
+		Password:  "hello",
+		Qop:       "auth-int",
+		NC:        1,
+		Cnonce:    params["cnonce"],
+		BodyHash:  BodyHash("", []byte("hello world")),
+	})
+	if err != nil || a != sent {
+		t.Errorf("invalid header: %s, %v\nsent: %s", a, err, sent)
+	}
+}
+
+func TestWithRandom(t *testing.T) {
+	var sent string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sent = r.Header.Get(authorization); sent == "" {
+			w.Header().Set(wwwAuthenticate, `Digest realm="example.com", nonce="abc", opaque="def", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	get := func(random io.Reader) (string, error) {
+		req, err := http.NewRequest("GET", ts.URL+"/a", nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := New(context.Background(), "john", "hello", WithRandom(random)).Do(req)
+		if err != nil {
+			return "", err
+		}
+		_ = resp.Body.Close()
+		return sent, nil
+	}
+
+	// the whole header is reproducible with a seeded source
+	first, err := get(rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatalf("error in get: %v", err)
+	}
+	if second, err := get(rand.New(rand.NewSource(1))); err != nil || second != first {
+		t.Errorf("header is not reproducible: %s, %v\nfirst: %s", second, err, first)
+	}
+
+	auth, err := get(bytes.NewReader([]byte{0, 1, 2, 3, 4, 5, 6, 7}))
+	if err != nil {
+		t.Fatalf("error in get: %v", err)
+	}
+	if c := parseAuthorization(auth)["cnonce"]; c != "0001020304050607" {
+		t.Errorf("invalid cnonce: %s", c)
+	}
+
+	if _, err := get(bytes.NewReader(nil)); err == nil || !strings.Contains(err.Error(), "cnonce") {
+		t.Errorf("invalid error for a source run dry: %v", err)
+	}
+}
+
+func TestRFC7616Vectors(t *testing.T) {
+	// the examples of RFC 7616 3.9.1
+	for _, tc := range []struct {
+		algorithm, response string
+	}{
+		{"MD5", "8ca523f5e9506fed4657c9700eebdbec"},
+		{"SHA-256", "753927fa0e85d155564e2e272a28d1802ca10daf4496794697cf8db5856cb6c1"},
+	} {
+		a, err := BuildAuthorization(AuthorizationParams{
+			Method: "GET",
+			URI:    "/dir/index.html",
+			Challenge: &Challenge{
+				Realm:     "http-auth@example.org",
+				Nonce:     "7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v",
+				Opaque:    "FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS",
+				Qop:       "auth, auth-int",
+				Algorithm: tc.algorithm,
+			},
+			Username: "Mufasa",
+			Password: "Circle of Life",
+			Qop:      "auth",
+			NC:       1,
+			Cnonce:   "f2/wE4q74E6zIJEtWaHKaf5wv/H5QzzpXusqGemxURZJ",
+		})
+		if err != nil {
+			t.Fatalf("error in BuildAuthorization with %s: %v", tc.algorithm, err)
+		}
+		if r := parseAuthorization(a)["response"]; r != tc.response {
+			t.Errorf("invalid response with %s: %s", tc.algorithm, r)
+		}
+		if alg := parseAuthorization(a)["algorithm"]; alg != tc.algorithm {
+			t.Errorf("invalid algorithm: %s", alg)
+		}
+	}
+
+	// the example of RFC 7616 3.9.2 does not reproduce as published, so
+	// userhash is checked against its definition with the inputs of it
+	c := &Challenge{
+		Realm:     "api@example.org",
+		Nonce:     "5TsQWLVdgBdmrQ0XsxbDODV+57QdFR34I9HAbC/RVvkK",
+		Opaque:    "HRPCssKJSGjCrkzDg8OhwpzCiGPChXYjwrI2QmXDnsOS",
+		Qop:       "auth",
+		Algorithm: "SHA-512-256",
+		Userhash:  true,
+	}
+	a, err := BuildAuthorization(AuthorizationParams{
+		Method:    "GET",
+		URI:       "/doe.json",
+		Challenge: c,
+		Username:  "J\u00e4s\u00f8n Doe",
+		Password:  "Secret, or not?",
+		Qop:       "auth",
+		NC:        1,
+		Cnonce:    "NTg6RKcb9boFIAS3KrFK9BGeh+iDa/sm6jUMp2wds69v",
+	})
+	if err != nil {
+		t.Fatalf("error in BuildAuthorization with userhash: %v", err)
+	}
+	sum := sha512.Sum512_256([]byte("J\u00e4s\u00f8n Doe:api@example.org"))
+	if u := parseAuthorization(a)["username"]; u != hex.EncodeToString(sum[:]) {
+		t.Errorf("invalid userhash: %s", u)
+	}
+}
+
+func TestResponseFunc(t *testing.T) {
+	// the default is the response of the RFC
+	s := newDigestServer("auth")
+	if err := testServerRequest(s, "GET", "", WithResponseFunc(Response)); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+
+	var sent map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sent = parseAuthorization(r.Header.Get(authorization)); sent == nil {
+			w.Header().Set(wwwAuthenticate, `Digest realm="example.com", nonce="abc", qop="auth"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer ts.Close()
+
+	vendor := func(in ResponseInput) string {
+		return in.Hash(in.HA1, in.Nonce, in.HA2, "extra")
+	}
+	r := New(context.Background(), "john", "hello", WithResponseFunc(vendor))
+	req, err := http.NewRequest("GET", ts.URL+"/a", nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	want := h(h("john:example.com:hello") + ":abc:" + h("GET:"+sent["uri"]) + ":extra")
+	if sent["response"] != want {
+		t.Errorf("invalid response: %s", sent["response"])
+	}
+}
@@ -0,0 +1,230 @@
+package digestRequest
+
+import (
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// session is the state of authentication with one realm of an origin: the
+// challenge being answered, and when its nonce was first seen and the nonce
+// count of it
+type session struct {
+	origin  *url.URL
+	history *nonceHistory
+
+	mu         sync.Mutex
+	challenge  *Challenge
+	firstSeen  time.Time
+	nonceCount nonceCount
+	// reused is how many requests took the challenge from the cache since
+	// the server sent it
+	reused int
+}
+
+// next returns the challenge to answer and the nc to send with it, or
+// ErrNonceExhausted when the nonce was sent with the last nc already
+func (s *session) next() (*Challenge, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.nonceCount == maxNonceCount {
+		return nil, "", ErrNonceExhausted
+	}
+	s.nonceCount++
+	return s.challenge, s.nonceCount.String(), nil
+}
+
+// exhausted tells whether the nonce was sent with the last nc already
+func (s *session) exhausted() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nonceCount == maxNonceCount
+}
+
+// update replaces the challenge as a whole, so that an opaque the server
+// changes is echoed from then on. nc starts over at 1 for a new nonce, but
+// goes on for one that was answered before, so that no nc is sent twice
+// with the same nonce.
+func (s *session) update(c *Challenge) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.challenge == nil || s.challenge.Nonce != c.Nonce {
+		if s.challenge != nil {
+			s.history.save(s.challenge.Nonce, s.nonceCount)
+		}
+		s.firstSeen = time.Now()
+		s.nonceCount = s.history.restore(c.Nonce)
+	}
+	s.challenge = c
+	s.reused = 0
+}
+
+// renew restarts the age of the nonce, which a probe got handed out again
+func (s *session) renew() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.firstSeen = time.Now()
+}
+
+// reuse counts a request taking the challenge from the cache, and returns
+// how many did before it
+func (s *session) reuse() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reused++
+	return s.reused - 1
+}
+
+// current returns the challenge being answered
+func (s *session) current() *Challenge {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.challenge
+}
+
+// stats returns when the nonce was first seen and how often it was used
+func (s *session) stats() NonceStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NonceStats{FirstSeen: s.firstSeen, Uses: int(s.nonceCount)}
+}
+
+// covers tells whether u is in the protection space of the session
+func (s *session) covers(u *url.URL) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.challenge.covers(s.origin, u)
+}
+
+// maxNonceHistory is how many nonces left behind nonceHistory remembers
+const maxNonceHistory = 64
+
+// nonceHistory remembers the last nc sent with the nonces left behind, for
+// servers which hand out a nonce again, e.g. from several backends
+type nonceHistory struct {
+	mu     sync.Mutex
+	nonces []string
+	counts map[string]nonceCount
+}
+
+func (h *nonceHistory) save(nonce string, count nonceCount) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[string]nonceCount)
+	}
+	if _, ok := h.counts[nonce]; !ok {
+		h.nonces = append(h.nonces, nonce)
+	}
+	h.counts[nonce] = count
+	if len(h.nonces) > maxNonceHistory {
+		delete(h.counts, h.nonces[0])
+		h.nonces = h.nonces[1:]
+	}
+}
+
+// restore returns the last nc sent with nonce, or 0 for a new one
+func (h *nonceHistory) restore(nonce string) nonceCount {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counts[nonce]
+}
+
+// sessionCache keeps the sessions per origin and realm, so that requests
+// reuse the nonce answered before instead of probing again
+type sessionCache struct {
+	mu      sync.Mutex
+	origins map[string]*originSessions
+	last    *session
+	// history outlives reset, since the server still knows the nonces
+	history nonceHistory
+}
+
+type originSessions struct {
+	current string
+	realms  map[string]*session
+}
+
+func originKey(u *url.URL) string {
+	return strings.ToLower(httpScheme(u.Scheme) + "://" + u.Host)
+}
+
+// get returns the session for u. A realm whose domain directive covers u is
+// preferred to the one used last on the origin.
+func (sc *sessionCache) get(u *url.URL) *session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	o, ok := sc.origins[originKey(u)]
+	if !ok {
+		return nil
+	}
+	for _, s := range o.realms {
+		if c := s.current(); len(c.Domain) > 0 && c.covers(s.origin, u) {
+			sc.last = s
+			return s
+		}
+	}
+	if s := o.realms[o.current]; s.covers(u) {
+		sc.last = s
+		return s
+	}
+	return nil
+}
+
+// lastUsed returns the session returned last, or nil
+func (sc *sessionCache) lastUsed() *session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.last
+}
+
+// put stores c, which was sent in reply to a request for origin, in the
+// session of its realm and makes that the current one of the origin
+func (sc *sessionCache) put(origin *url.URL, c *Challenge) *session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.origins == nil {
+		sc.origins = make(map[string]*originSessions)
+	}
+	key := originKey(origin)
+	o, ok := sc.origins[key]
+	if !ok {
+		o = &originSessions{realms: make(map[string]*session)}
+		sc.origins[key] = o
+	}
+	s, ok := o.realms[c.Realm]
+	if !ok {
+		s = &session{origin: origin, history: &sc.history}
+		o.realms[c.Realm] = s
+	}
+	s.update(c)
+	o.current = c.Realm
+	sc.last = s
+	return s
+}
+
+// hosts returns the current sessions by origin
+func (sc *sessionCache) hosts() map[string]*session {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	hosts := make(map[string]*session, len(sc.origins))
+	for key, o := range sc.origins {
+		hosts[key] = o.realms[o.current]
+	}
+	return hosts
+}
+
+func (sc *sessionCache) reset() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, o := range sc.origins {
+		for _, s := range o.realms {
+			s.mu.Lock()
+			sc.history.save(s.challenge.Nonce, s.nonceCount)
+			s.mu.Unlock()
+		}
+	}
+	sc.origins = nil
+	sc.last = nil
+}
@@ -0,0 +1,395 @@
+package digestRequest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const algorithm = "algorithm"
+const domain = "domain"
+const nextnonce = "nextnonce"
+const nonce = "nonce"
+const opaque = "opaque"
+const qop = "qop"
+const realm = "realm"
+const stale = "stale"
+const userhash = "userhash"
+
+// Challenge is a digest challenge sent by the server. Quoted values are kept
+// byte-for-byte as sent, backslash escapes included, so that they are echoed
+// to the server exactly.
+type Challenge struct {
+	Realm  string
+	Nonce  string
+	Opaque string
+	// Qop is the list of qop options offered, such as "auth,auth-int". It
+	// is empty for servers of RFC 2069, which are answered without qop.
+	Qop string
+	// Algorithm is MD5, SHA-256 or SHA-512-256 in any case, or empty for
+	// MD5
+	Algorithm string
+	Stale     bool
+	// Domain is the list of URIs in the protection space. When it is empty,
+	// the whole origin the challenge came from is.
+	Domain []string
+	// Userhash tells that the server accepts the username hashed, as in
+	// RFC 7616
+	Userhash bool
+	// Body is the start of the body of the rejection which carried the
+	// challenge to the probe, kept with WithRejectionBody
+	Body []byte
+}
+
+// parseChallenge reads the digest challenge in resp. The interceptor set by
+// WithChallengeInterceptor sees it before it is validated.
+//
+// A server may offer several challenges, for different realms. The first
+// valid one is taken, or with WithCredentialProvider the first one whose
+// realm there are credentials for.
+func (r *DigestRequest) parseChallenge(resp *http.Response) (*Challenge, error) {
+	values := resp.Header[r.challengeHeader]
+	if len(values) == 0 {
+		return nil, fmt.Errorf("headers do not have %s", r.challengeHeader)
+	}
+
+	for _, v := range values {
+		if err := checkQuotes(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if schemes := offeredSchemes(values); len(schemes) > 0 && !containsFold(schemes, digestScheme) {
+		return nil, &SchemeError{Schemes: schemes}
+	}
+
+	var firstErr error
+	var realms []string
+	for _, directives := range challengeDirectives(values) {
+		c, err := r.readChallenge(directives)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if _, ok := r.credentialsFor(c, credentials{}); !ok {
+			realms = append(realms, c.Realm)
+			continue
+		}
+		return c, nil
+	}
+	if len(realms) == 0 {
+		return nil, firstErr
+	}
+	return nil, fmt.Errorf("no credentials for realm: %s", strings.Join(realms, ", "))
+}
+
+// readChallenge makes the challenge of directives and validates it
+func (r *DigestRequest) readChallenge(directives []string) (*Challenge, error) {
+	c := &Challenge{}
+	for _, d := range directives {
+		k, v := splitDirective(d)
+		if strings.HasPrefix(v, `"`) {
+			return nil, fmt.Errorf("malformed value of %s", k)
+		}
+		switch k {
+		case realm:
+			c.Realm = v
+		case nonce:
+			c.Nonce = v
+		case opaque:
+			c.Opaque = v
+		case qop:
+			c.Qop = v
+		case algorithm:
+			c.Algorithm = v
+		case stale:
+			c.Stale = strings.EqualFold(v, "true")
+		case domain:
+			c.Domain = strings.Fields(unquote(v))
+		case userhash:
+			c.Userhash = strings.EqualFold(v, "true")
+		}
+	}
+
+	if c.Realm == "" {
+		c.Realm = r.defaultRealm
+	}
+	if r.interceptor != nil {
+		r.interceptor(c)
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	if err := r.checkAlgorithm(c); err != nil {
+		return nil, err
+	}
+	// credentials for one realm must not be sent to a server claiming another
+	if r.expectedRealm != "" && unquote(c.Realm) != r.expectedRealm {
+		return nil, fmt.Errorf("unexpected realm: %s", c.Realm)
+	}
+	return c, nil
+}
+
+// checkAlgorithm refuses the algorithm of c unless WithAllowedAlgorithms
+// allows it. A challenge without one is MD5.
+func (r *DigestRequest) checkAlgorithm(c *Challenge) error {
+	if r.allowedAlgorithms == nil {
+		return nil
+	}
+	alg := c.Algorithm
+	if alg == "" {
+		alg = algorithmMD5
+	}
+	for _, a := range r.allowedAlgorithms {
+		if strings.EqualFold(a, alg) {
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm is not allowed: %s", alg)
+}
+
+// validate checks that c has everything needed to answer it. The opaque and
+// qop are optional, and only echoed when the server sent them.
+func (c *Challenge) validate() error {
+	var missing []string
+	if c.Nonce == "" {
+		missing = append(missing, nonce)
+	}
+	if c.Realm == "" {
+		if len(missing) == 0 {
+			return ErrMissingRealm
+		}
+		missing = append(missing, realm)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("header is invalid: missing required directives: [%s]", strings.Join(missing, ", "))
+	}
+	if lookupAlgorithm(c.Algorithm) == nil {
+		return fmt.Errorf("unsupported algorithm: %s", c.Algorithm)
+	}
+	return nil
+}
+
+// String formats c for errors and logs. The nonce and the opaque are state
+// of the session with the server, so they are redacted; an empty one is
+// left empty to show that it is missing.
+func (c Challenge) String() string {
+	return fmt.Sprintf("{Realm:%s Nonce:%s Opaque:%s Qop:%s Algorithm:%s Stale:%t Domain:%v Userhash:%t}",
+		c.Realm, redact(c.Nonce), redact(c.Opaque), c.Qop, c.Algorithm, c.Stale, c.Domain, c.Userhash)
+}
+
+// redacted replaces secrets in errors and formatted values
+const redacted = "[REDACTED]"
+
+func redact(v string) string {
+	if v == "" {
+		return ""
+	}
+	return redacted
+}
+
+// unquote resolves the backslash escapes of a quoted-string value
+func unquote(v string) string {
+	if !strings.Contains(v, `\`) {
+		return v
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range v {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+const digestScheme = "Digest"
+
+// digestParams returns the directives of a challenge after the scheme, which
+// is matched case-insensitively. A UTF-8 BOM and whitespace sent by broken
+// servers before it are ignored.
+func digestParams(header string) string {
+	header = strings.TrimLeft(header, " \t\ufeff")
+	if n := len(digestScheme); len(header) > n && strings.EqualFold(header[:n], digestScheme) && header[n] == ' ' {
+		return header[n+1:]
+	}
+	return header
+}
+
+// challengeDirectives returns the directives of every Digest challenge in
+// the values of the challenge header, whatever the case of the scheme. A
+// value may hold several challenges separated by commas, each starting with
+// its scheme, as in
+// `Basic realm="a", Digest realm="b", nonce="c"`. Values which have no
+// Digest challenge in that form are read as one, as they always were.
+func challengeDirectives(values []string) [][]string {
+	var challenges [][]string
+	for _, v := range values {
+		var current []string
+		digest := false
+		for _, d := range splitDirectives(strings.TrimLeft(v, " \t\ufeff")) {
+			scheme, rest, ok := splitScheme(d)
+			if ok {
+				if digest {
+					challenges = append(challenges, current)
+				}
+				current, digest = nil, strings.EqualFold(scheme, digestScheme)
+				d = rest
+			}
+			if digest && strings.TrimSpace(d) != "" {
+				current = append(current, d)
+			}
+		}
+		if digest {
+			challenges = append(challenges, current)
+		}
+	}
+	if len(challenges) == 0 {
+		return [][]string{splitDirectives(digestParams(values[0]))}
+	}
+	return challenges
+}
+
+// knownSchemes are the registered schemes which are sent without parameters
+var knownSchemes = []string{"Basic", "Bearer", "Negotiate", "NTLM", "Kerberos", "HOBA", "Mutual"}
+
+// offeredSchemes returns the schemes of the challenges in values, each once.
+// A lone word is only taken for a scheme if it is a known one, as it may be
+// a directive of a broken challenge otherwise.
+func offeredSchemes(values []string) []string {
+	var schemes []string
+	for _, v := range values {
+		for _, d := range splitDirectives(v) {
+			scheme, rest, ok := splitScheme(d)
+			if !ok || strings.TrimSpace(rest) == "" && !containsFold(knownSchemes, scheme) {
+				continue
+			}
+			if !containsFold(schemes, scheme) {
+				schemes = append(schemes, scheme)
+			}
+		}
+	}
+	return schemes
+}
+
+func containsFold(list []string, s string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitScheme splits the scheme off a challenge which starts at d, as in
+// `Digest realm="a"`. ok is false when d is a directive.
+func splitScheme(d string) (scheme, rest string, ok bool) {
+	d = strings.TrimLeft(d, " \t\ufeff")
+	i := strings.IndexAny(d, " \t")
+	if i < 0 {
+		i = len(d)
+	}
+	if i == 0 || strings.ContainsAny(d[:i], `="`) {
+		return "", "", false
+	}
+	// a name followed by spaces and "=" is a directive too
+	if rest := strings.TrimLeft(d[i:], " \t"); strings.HasPrefix(rest, "=") {
+		return "", "", false
+	}
+	return d[:i], d[i:], true
+}
+
+// splitDirective splits a directive into its name in lowercase and value
+// with the quotes removed. It accepts values with or without quotes, as IIS
+// sends qop=auth unquoted, and names in any case, as in Nonce="abc".
+func splitDirective(directive string) (string, string) {
+	i := strings.Index(directive, "=")
+	if i < 0 {
+		return strings.ToLower(strings.TrimSpace(directive)), ""
+	}
+	k := strings.ToLower(strings.TrimSpace(directive[:i]))
+	v := strings.TrimSpace(directive[i+1:])
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	return k, v
+}
+
+// checkQuotes makes sure that every quoted-string in header ends, so that a
+// broken header is an error instead of directives running into each other
+func checkQuotes(header string) error {
+	quoted, escaped := false, false
+	for _, c := range header {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		}
+	}
+	if quoted {
+		return fmt.Errorf("header has an unterminated quoted string")
+	}
+	return nil
+}
+
+// splitDirectives splits a challenge at the commas outside quoted strings.
+// Some embedded servers separate directives with spaces instead, as in
+// `realm="a" nonce="b"`, so it splits at spaces too where a directive with a
+// value is followed by the name of another one.
+func splitDirectives(header string) []string {
+	var directives []string
+	quoted, escaped := false, false
+	start := 0
+	for i, c := range header {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			directives = append(directives, header[start:i])
+			start = i + 1
+		case (c == ' ' || c == '\t') && !quoted && hasValue(header[start:i]) && startsDirective(header[i:]):
+			directives = append(directives, header[start:i])
+			start = i
+		}
+	}
+	return append(directives, header[start:])
+}
+
+// hasValue tells whether d is a directive with its value, as in `realm="a"`
+func hasValue(d string) bool {
+	i := strings.Index(d, "=")
+	return i > 0 && strings.TrimSpace(d[i+1:]) != ""
+}
+
+// startsDirective tells whether s starts with the name of a directive and
+// "=", after spaces
+func startsDirective(s string) bool {
+	s = strings.TrimLeft(s, " \t")
+	n := 0
+	for n < len(s) && isTokenChar(s[n]) {
+		n++
+	}
+	if n == 0 {
+		return false
+	}
+	s = strings.TrimLeft(s[n:], " \t")
+	return strings.HasPrefix(s, "=") && !strings.HasPrefix(s, "==")
+}
+
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
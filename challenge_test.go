@@ -0,0 +1,274 @@
+package digestRequest
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func testParseChallenge(header string, opts ...Option) (*Challenge, error) {
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set(wwwAuthenticate, header)
+	return New(context.Background(), "john", "hello", opts...).parseChallenge(resp)
+}
+
+func TestParseChallengeKeepsOpaqueVerbatim(t *testing.T) {
+	c, err := testParseChallenge(`Digest realm="example.com", nonce="n\"1", opaque=" a\"b, c\\d ", qop="auth"`)
+	if err != nil {
+		t.Fatalf("error in parseChallenge: %v", err)
+	}
+	if c.Opaque != ` a\"b, c\\d ` {
+		t.Errorf("opaque is changed: %s", c.Opaque)
+	}
+	if c.Nonce != `n\"1` {
+		t.Errorf("nonce is changed: %s", c.Nonce)
+	}
+	if n := unquote(c.Nonce); n != `n"1` {
+		t.Errorf("invalid unquoted nonce: %s", n)
+	}
+}
+
+func TestParseChallengeWithLeadingBOM(t *testing.T) {
+	for _, header := range []string{
+		"\ufeffDigest realm=\"example.com\", nonce=\"abc\", opaque=\"def\", qop=\"auth\"",
+		"  \ufeff Digest realm=\"example.com\", nonce=\"abc\", opaque=\"def\", qop=\"auth\"",
+		"\t Digest realm=\"example.com\", nonce=\"abc\", opaque=\"def\", qop=\"auth\"",
+	} {
+		c, err := testParseChallenge(header)
+		if err != nil {
+			t.Errorf("error in parseChallenge(%q): %v", header, err)
+		} else if c.Realm != "example.com" {
+			t.Errorf("invalid realm for %q: %s", header, c.Realm)
+		}
+	}
+}
+
+func TestInvalidChallengeIsRedacted(t *testing.T) {
+	_, err := testParseChallenge(`Digest nonce="secret-nonce", opaque="secret-opaque", qop="auth"`)
+	if err == nil {
+		t.Fatal("invalid challenge is accepted")
+	}
+	if strings.Contains(err.Error(), "secret-nonce") || strings.Contains(err.Error(), "secret-opaque") {
+		t.Errorf("nonce is not redacted: %v", err)
+	}
+	if !strings.Contains(err.Error(), "[realm]") {
+		t.Errorf("missing realm is not shown: %v", err)
+	}
+}
+
+func TestAllowedAlgorithms(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		opts    []Option
+		allowed bool
+	}{
+		{`Digest realm="r", nonce="n", opaque="o", qop="auth"`, nil, true},
+		{`Digest realm="r", nonce="n", opaque="o", qop="auth"`, []Option{WithAllowedAlgorithms("SHA-256")}, false},
+		{`Digest realm="r", nonce="n", opaque="o", qop="auth", algorithm=MD5`, []Option{WithAllowedAlgorithms("SHA-256")}, false},
+		{`Digest realm="r", nonce="n", opaque="o", qop="auth"`, []Option{WithAllowedAlgorithms("SHA-256", "md5")}, true},
+	} {
+		_, err := testParseChallenge(tc.header, tc.opts...)
+		if (err == nil) != tc.allowed {
+			t.Errorf("invalid result for %s with %d options: %v", tc.header, len(tc.opts), err)
+		}
+	}
+}
+
+func TestExpectedRealm(t *testing.T) {
+	header := `Digest realm="a@example.com", nonce="n", opaque="o", qop="auth"`
+	if _, err := testParseChallenge(header, WithExpectedRealm("a@example.com")); err != nil {
+		t.Errorf("error in parseChallenge: %v", err)
+	}
+	if _, err := testParseChallenge(header, WithExpectedRealm("b@example.com")); err == nil {
+		t.Error("unexpected realm is accepted")
+	}
+}
+
+func TestParseMultipleChallenges(t *testing.T) {
+	a := `Digest realm="a", nonce="n1", opaque="o", qop="auth"`
+	b := `Digest realm="b", nonce="n2, n3", opaque="o", qop="auth", algorithm=MD5`
+	provider := func(realm string) (string, string, bool) {
+		return "john", "hello", realm == "b"
+	}
+	for _, values := range [][]string{
+		{a + ", " + b},
+		{a, b},
+		{`Basic realm="a"`, a + ",  " + b},
+		{`Basic realm="a", ` + a, `Negotiate abc==, ` + b},
+	} {
+		resp := &http.Response{Header: http.Header{wwwAuthenticate: values}}
+		c, err := New(context.Background(), "", "").parseChallenge(resp)
+		if err != nil || c.Realm != "a" {
+			t.Errorf("invalid challenge for %q: %+v, %v", values, c, err)
+		}
+		c, err = New(context.Background(), "", "", WithCredentialProvider(provider)).parseChallenge(resp)
+		if err != nil || c.Realm != "b" || c.Nonce != "n2, n3" || c.Algorithm != algorithmMD5 {
+			t.Errorf("invalid challenge with the provider for %q: %+v, %v", values, c, err)
+		}
+		c, err = New(context.Background(), "", "", WithExpectedRealm("b")).parseChallenge(resp)
+		if err != nil || c.Realm != "b" {
+			t.Errorf("invalid challenge for the expected realm for %q: %+v, %v", values, c, err)
+		}
+	}
+
+	none := func(string) (string, string, bool) { return "", "", false }
+	_, err := testParseChallenge(a+", "+b, WithCredentialProvider(none))
+	if err == nil || !strings.Contains(err.Error(), "a, b") {
+		t.Errorf("invalid error without credentials: %v", err)
+	}
+}
+
+func TestSplitScheme(t *testing.T) {
+	for _, tc := range []struct {
+		d, scheme string
+	}{
+		{`Digest realm="a"`, "Digest"},
+		{` Basic`, "Basic"},
+		{`realm="a"`, ""},
+		{`realm = "a"`, ""},
+		{`nonce="a b"`, ""},
+	} {
+		if scheme, _, _ := splitScheme(tc.d); scheme != tc.scheme {
+			t.Errorf("invalid scheme of %q: %q", tc.d, scheme)
+		}
+	}
+}
+
+func TestParseMalformedChallenges(t *testing.T) {
+	for _, header := range []string{
+		`Digest realm="example.com", nonce="abc, opaque="def", qop="auth`,
+		`Digest realm="example.com", nonce=", opaque="def", qop="auth"`,
+		`Digest realm="example.com", nonce="abc\", opaque="def", qop=auth`,
+		`Digest realm=", nonce`,
+		`Digest realm="`,
+		`"`,
+	} {
+		if c, err := testParseChallenge(header); err == nil {
+			t.Errorf("malformed challenge %q is accepted: %+v", header, c)
+		}
+	}
+	// qop unquoted, as IIS sends it
+	if _, err := testParseChallenge(`Digest realm="example.com", nonce="abc", opaque="def", qop=auth`); err != nil {
+		t.Errorf("error in parseChallenge: %v", err)
+	}
+}
+
+func TestParseChallengeSchemeCase(t *testing.T) {
+	for _, scheme := range []string{"Digest", "digest", "DIGEST", "dIgEsT"} {
+		for _, header := range []string{
+			scheme + ` realm="example.com", nonce="abc", opaque="def", qop="auth"`,
+			`Basic realm="other", ` + scheme + ` realm="example.com", nonce="abc", opaque="def", qop="auth"`,
+		} {
+			c, err := testParseChallenge(header)
+			if err != nil || c.Realm != "example.com" || c.Nonce != "abc" {
+				t.Errorf("invalid challenge for %q: %+v, %v", header, c, err)
+			}
+		}
+	}
+}
+
+func TestParseChallengeAmongOtherSchemes(t *testing.T) {
+	digest := `Digest realm="example.com", nonce="abc", opaque="def", qop="auth"`
+	for _, values := range [][]string{
+		{"Negotiate", "NTLM", digest},
+		{"Negotiate, NTLM, " + digest},
+		{`Negotiate oRswGaADCgEAoxIEEAEAAAB=`, `NTLM TlRMTVNTUAACAAAA==`, digest, `Basic realm="example.com"`},
+	} {
+		resp := &http.Response{Header: http.Header{wwwAuthenticate: values}}
+		c, err := New(context.Background(), "john", "hello").parseChallenge(resp)
+		if err != nil || c.Realm != "example.com" || c.Nonce != "abc" {
+			t.Errorf("invalid challenge for %q: %+v, %v", values, c, err)
+		}
+	}
+}
+
+func TestParseChallengeWithoutDigest(t *testing.T) {
+	for _, tc := range []struct {
+		values  []string
+		schemes []string
+	}{
+		{[]string{`Basic realm="example.com"`}, []string{"Basic"}},
+		{[]string{"Negotiate", "NTLM", `Basic realm="a", basic realm="b"`}, []string{"Negotiate", "NTLM", "Basic"}},
+		{[]string{`Negotiate oRswGaADCgEAoxIEEAEAAAB=, NTLM`}, []string{"Negotiate", "NTLM"}},
+	} {
+		resp := &http.Response{Header: http.Header{wwwAuthenticate: tc.values}}
+		_, err := New(context.Background(), "john", "hello").parseChallenge(resp)
+		e, ok := err.(*SchemeError)
+		if !ok || !reflect.DeepEqual(e.Schemes, tc.schemes) {
+			t.Errorf("invalid error for %q: %v", tc.values, err)
+		}
+	}
+
+	// a malformed Digest challenge, or a word which may be anything, is not
+	// mistaken for other schemes
+	if _, err := testParseChallenge("hoge"); err == nil || !strings.Contains(err.Error(), "header is invalid") {
+		t.Errorf("invalid error for a lone word: %v", err)
+	}
+	_, err := testParseChallenge(`Basic realm="a", Digest realm="b"`)
+	if _, ok := err.(*SchemeError); ok || err == nil {
+		t.Errorf("invalid error for a malformed Digest challenge: %v", err)
+	}
+	e := &SchemeError{Schemes: []string{"Basic", "NTLM"}}
+	if e.Error() != "server offers Basic, NTLM but not Digest" {
+		t.Errorf("invalid message: %s", e.Error())
+	}
+}
+
+func TestParseSpaceSeparatedChallenge(t *testing.T) {
+	for _, header := range []string{
+		`Digest realm="example.com" nonce="abc" opaque="def" qop="auth"`,
+		`Digest realm="example.com"	nonce="abc",opaque="def" qop=auth`,
+		`Digest realm = "example.com" nonce="abc"  opaque="def", qop="auth"`,
+		`realm="example.com" nonce="abc" opaque="def" qop="auth"`,
+	} {
+		c, err := testParseChallenge(header)
+		if err != nil || c.Realm != "example.com" || c.Nonce != "abc" || c.Opaque != "def" || c.Qop != "auth" {
+			t.Errorf("invalid challenge for %q: %+v, %v", header, c, err)
+		}
+	}
+
+	// spaces in quoted strings and before values stay where they are
+	c, err := testParseChallenge(`Digest realm="a b" nonce="c d=e" opaque= "f"`)
+	if err != nil || c.Realm != "a b" || c.Nonce != "c d=e" || c.Opaque != "f" {
+		t.Errorf("invalid challenge: %+v, %v", c, err)
+	}
+}
+
+func TestParseIncompleteChallenge(t *testing.T) {
+	for _, tc := range []struct {
+		header, err string
+	}{
+		{`Digest opaque="def", qop="auth"`, "missing required directives: [nonce, realm]"},
+		{`Digest realm="example.com", qop="auth"`, "missing required directives: [nonce]"},
+		{`Digest nonce="abc"`, "missing required directives: [realm]"},
+	} {
+		if _, err := testParseChallenge(tc.header); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("invalid error for %q: %v", tc.header, err)
+		}
+	}
+
+	// a realm alone is told apart
+	if _, err := testParseChallenge(`Digest nonce="abc", qop="auth", opaque="def"`); err != ErrMissingRealm {
+		t.Errorf("invalid error without realm: %v", err)
+	}
+
+	// opaque and qop are optional
+	c, err := testParseChallenge(`Digest realm="example.com", nonce="abc"`)
+	if err != nil || c.Opaque != "" || c.Qop != "" {
+		t.Errorf("invalid challenge: %+v, %v", c, err)
+	}
+}
+
+func TestParseChallengeDirectiveCase(t *testing.T) {
+	// as sent by an embedded web server
+	c, err := testParseChallenge(`Digest Realm="example.com", Nonce="abc", Opaque="def", Qop="auth", Algorithm=MD5, STALE=TRUE`)
+	if err != nil {
+		t.Fatalf("error in parseChallenge: %v", err)
+	}
+	if c.Realm != "example.com" || c.Nonce != "abc" || c.Opaque != "def" || c.Qop != "auth" || c.Algorithm != "MD5" || !c.Stale {
+		t.Errorf("invalid challenge: %+v", c)
+	}
+}
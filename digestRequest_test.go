@@ -1,12 +1,22 @@
 package digestRequest
 
 import (
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/pkg/errors"
@@ -75,6 +85,22 @@ func TestDigestRequestWithClient(t *testing.T) {
 	}
 }
 
+func TestContextClientIsNotShared(t *testing.T) {
+	client := &http.Client{Timeout: time.Minute}
+	ctx := ContextWithClient(context.Background(), client)
+	a := New(ctx, "john", "hello", WithDisableCompression())
+	b := New(ctx, "john", "hello")
+	if client.Transport != nil {
+		t.Error("the client given is modified")
+	}
+	if !a.client.Transport.(*http.Transport).DisableCompression || b.client.Transport.(*http.Transport).DisableCompression {
+		t.Error("the transport is shared")
+	}
+	if a.client.Timeout != time.Minute {
+		t.Errorf("invalid timeout: %v", a.client.Timeout)
+	}
+}
+
 func TestDigestRequestWithoutClient(t *testing.T) {
 	if err := testRequest(digestHandler, nil); err != nil {
 		t.Errorf("error in testRequest: %v", err)
@@ -129,3 +155,3110 @@ func TestInvalidRequests(t *testing.T) {
 		t.Fatalf("no error")
 	}
 }
+
+func TestDoWithTimeoutOutlivesReadWriteTimeout(t *testing.T) {
+	// the probe is answered with a challenge right away, so that only the
+	// authorized request is slow
+	s := newDigestServer("auth")
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "O")
+		w.(http.Flusher).Flush()
+		time.Sleep(readWriteTimeout + 500*time.Millisecond)
+		fmt.Fprintf(w, "K")
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+
+	resp, err := New(context.Background(), "john", "hello").DoWithTimeout(req, 10*time.Second)
+	if err != nil {
+		t.Fatalf("error in DoWithTimeout: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error in ReadAll: %v", err)
+	}
+	if string(b) != "OK" {
+		t.Errorf("invalid body: %s", string(b))
+	}
+}
+
+func TestDoWithTimeoutExpires(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprintf(w, "OK")
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+
+	_, err = New(context.Background(), "john", "hello").DoWithTimeout(req, 50*time.Millisecond)
+	if err == nil {
+		t.Fatalf("no error")
+	}
+}
+
+func testServerRequest(s *digestServer, method, body string, opts ...Option) error {
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest(method, ts.URL, strings.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "error in NewRequest")
+	}
+
+	resp, err := New(context.Background(), "john", "hello", opts...).Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error in Do")
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error status code: %s", resp.Status)
+	}
+	return nil
+}
+
+func TestBodiesOfAllMethods(t *testing.T) {
+	content := `{"name":"john"}`
+	for _, method := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+		for _, qop := range []string{"auth", "auth-int"} {
+			for _, getBody := range []bool{true, false} {
+				s := newDigestServer(qop)
+				// HA2 is checked with the method the server got
+				s.accept = func(r *http.Request, params map[string]string) bool {
+					return r.Method == method && r.ContentLength == int64(len(content))
+				}
+				ts := httptest.NewServer(s)
+
+				var body io.Reader = strings.NewReader(content)
+				if !getBody {
+					body = ioutil.NopCloser(body)
+				}
+				req, err := http.NewRequest(method, ts.URL, body)
+				if err != nil {
+					t.Fatalf("error in NewRequest: %v", err)
+				}
+				resp, err := New(context.Background(), "john", "hello").Do(req)
+				if err != nil {
+					t.Fatalf("error in Do of %s with %s: %v", method, qop, err)
+				}
+				_ = resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("error status code of %s with %s: %s", method, qop, resp.Status)
+				}
+				if b := s.bodies[len(s.bodies)-1]; b != content {
+					t.Errorf("invalid body of %s with %s and GetBody %t: %q", method, qop, getBody, b)
+				}
+				ts.Close()
+			}
+		}
+	}
+}
+
+func TestPreferredQopAuthInt(t *testing.T) {
+	s := newDigestServer("auth,auth-int")
+	if err := testServerRequest(s, "POST", "hello world", WithPreferredQop("auth-int")); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	if q := s.lastAuthorization()["qop"]; q != "auth-int" {
+		t.Errorf("qop is not auth-int: %s", q)
+	}
+	if b := s.bodies[len(s.bodies)-1]; b != "hello world" {
+		t.Errorf("invalid body: %s", b)
+	}
+}
+
+func TestQopDefaultsToAuth(t *testing.T) {
+	s := newDigestServer("auth,auth-int")
+	if err := testServerRequest(s, "POST", "hello world"); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	if q := s.lastAuthorization()["qop"]; q != "auth" {
+		t.Errorf("qop is not auth: %s", q)
+	}
+}
+
+func TestStrictQop(t *testing.T) {
+	s := newDigestServer("auth")
+	err := testServerRequest(s, "POST", "hello world", WithPreferredQop("auth-int"), WithStrictQop())
+	if err == nil || !strings.Contains(err.Error(), "server does not offer qop auth-int") {
+		t.Errorf("different error: %v", err)
+	}
+}
+
+func TestAuthIntStreamsGetBody(t *testing.T) {
+	s := newDigestServer("auth-int")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	content := strings.Repeat("0123456789", 100000)
+	req, err := http.NewRequest("PUT", ts.URL, ioutil.NopCloser(strings.NewReader(content)))
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	calls := 0
+	req.GetBody = func() (io.ReadCloser, error) {
+		calls++
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	if calls != 2 {
+		t.Errorf("GetBody should be called twice, but called %d times", calls)
+	}
+	if b := s.bodies[len(s.bodies)-1]; b != content {
+		t.Errorf("invalid body: %d bytes", len(b))
+	}
+}
+
+func TestContextWithBodyHash(t *testing.T) {
+	s := newDigestServer("auth-int")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	content := "hello world"
+	for _, tc := range []struct {
+		hash string
+		ok   bool
+	}{
+		{BodyHash("", []byte(content)), true},
+		{BodyHash("", []byte("something else")), false},
+	} {
+		req, err := http.NewRequest("PUT", ts.URL, strings.NewReader(content))
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		getBody := req.GetBody
+		calls := 0
+		req.GetBody = func() (io.ReadCloser, error) {
+			calls++
+			return getBody()
+		}
+		req = req.WithContext(ContextWithBodyHash(req.Context(), tc.hash))
+
+		resp, err := New(context.Background(), "john", "hello").Do(req)
+		if !tc.ok {
+			// the server hashes the body itself, so the wrong hash is rejected
+			if _, ok := err.(*RetryError); !ok {
+				t.Errorf("invalid error: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("error status code: %s", resp.Status)
+		}
+		if calls != 0 {
+			t.Errorf("GetBody should not be called, but called %d times", calls)
+		}
+	}
+}
+
+func TestMaxBodyBuffer(t *testing.T) {
+	for _, qop := range []string{"auth", "auth-int"} {
+		s := newDigestServer(qop)
+		ts := httptest.NewServer(s)
+
+		for _, tc := range []struct {
+			content string
+			getBody bool
+			err     error
+		}{
+			{strings.Repeat("x", 100), false, nil},
+			{strings.Repeat("x", 101), false, ErrBodyTooLarge},
+			{strings.Repeat("x", 101), true, nil},
+		} {
+			// a plain reader hides the length and GetBody from NewRequest
+			req, err := http.NewRequest("PUT", ts.URL, ioutil.NopCloser(strings.NewReader(tc.content)))
+			if err != nil {
+				t.Fatalf("error in NewRequest: %v", err)
+			}
+			if tc.getBody {
+				req.GetBody = func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(tc.content)), nil
+				}
+			}
+			resp, err := New(context.Background(), "john", "hello", WithMaxBodyBuffer(100)).Do(req)
+			if err != tc.err {
+				t.Errorf("invalid error for %s with %d bytes: %v", qop, len(tc.content), err)
+			}
+			if err == nil {
+				_ = resp.Body.Close()
+			}
+		}
+		ts.Close()
+	}
+
+	// a body known to be too large is closed without being read
+	body := &closeRecorder{Reader: strings.NewReader(strings.Repeat("x", 101))}
+	req, err := http.NewRequest("PUT", "http://example.com/", body)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.ContentLength = 101
+	if err := New(context.Background(), "john", "hello", WithMaxBodyBuffer(100)).replayableBody(req); err != ErrBodyTooLarge || !body.closed {
+		t.Errorf("invalid result: %v, closed %t", err, body.closed)
+	}
+}
+
+// closeRecorder is a request body which records whether it is closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (b *closeRecorder) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestWrongPasswordStopsRetrying(t *testing.T) {
+	s := newDigestServer("auth")
+	s.password = "wrong"
+	err := testServerRequest(s, "GET", "")
+	if e, ok := errors.Cause(err).(*RetryError); !ok || e.Retries != 1 || e.StaleRetries != 0 {
+		t.Fatalf("different error: %v", err)
+	}
+	// the probe, the authenticated request and a single retry
+	if n := s.requests(); n != 3 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestWithMaxRetriesZero(t *testing.T) {
+	s := newDigestServer("auth")
+	s.password = "wrong"
+	err := testServerRequest(s, "GET", "", WithMaxRetries(0))
+	if _, ok := errors.Cause(err).(*RetryError); !ok {
+		t.Fatalf("different error: %v", err)
+	}
+	if n := s.requests(); n != 2 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestStaleNonceIsRetried(t *testing.T) {
+	s := newDigestServer("auth")
+	staled := 0
+	s.beforeCheck = func(params map[string]string) {
+		// every nonce expires right before its first use, twice
+		if staled < 2 {
+			staled++
+			s.rotateNonce(true)
+		}
+	}
+	if err := testServerRequest(s, "POST", "hello world", WithMaxRetries(0), WithNonIdempotentRetries()); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	if b := s.bodies[len(s.bodies)-1]; b != "hello world" {
+		t.Errorf("invalid body: %s", b)
+	}
+}
+
+func TestStaleRetriesAreBounded(t *testing.T) {
+	s := newDigestServer("auth")
+	s.beforeCheck = func(params map[string]string) { s.rotateNonce(true) }
+	err := testServerRequest(s, "GET", "")
+	if e, ok := errors.Cause(err).(*RetryError); !ok || e.StaleRetries != maxStaleRetries {
+		t.Fatalf("different error: %v", err)
+	}
+}
+
+func TestNonceExpiredAfterProbeIsRetried(t *testing.T) {
+	s := newDigestServer("auth")
+	rotated := false
+	s.beforeCheck = func(params map[string]string) {
+		// the nonce from the probe expires before the authenticated request
+		// arrives, and the server does not say it is stale
+		if !rotated {
+			rotated = true
+			s.rotateNonce(false)
+		}
+	}
+	if err := testServerRequest(s, "GET", ""); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	// the retry uses the challenge of the rejection without probing again
+	if n := s.requests(); n != 3 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	if n := s.lastAuthorization()["nonce"]; n != s.nonce {
+		t.Errorf("retry does not use the new nonce: %s", n)
+	}
+}
+
+func TestUnauthorizedWithoutChallengeIsReturned(t *testing.T) {
+	probed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !probed {
+			probed = true
+			w.Header().Set(wwwAuthenticate, `Digest realm="example.com", nonce="abc", opaque="def", qop="auth"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+}
+
+func TestIISCompat(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rawChallenge = fmt.Sprintf(`Digest qop=auth,algorithm=MD5,realm="%s",nonce="%s",opaque="%s"`, s.realm, s.nonce, s.opaque)
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return params["uri"] == r.RequestURI && params["algorithm"] == "MD5"
+	}
+
+	if err := testServerRequest(s, "GET", ""); err == nil {
+		t.Errorf("absolute uri should be rejected")
+	}
+	if err := testServerRequest(s, "GET", "", WithIISCompat()); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestUnsupportedAlgorithm(t *testing.T) {
+	err := testNormalRequest(func(w http.ResponseWriter) {
+		w.Header().Set(wwwAuthenticate, `Digest realm="example.com", nonce="abc", opaque="def", qop="auth", algorithm=SHA-999`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+	if err == nil || !strings.Contains(err.Error(), "unsupported algorithm: SHA-999") {
+		t.Errorf("different error: %v", err)
+	}
+}
+
+func TestCustomHeaderNames(t *testing.T) {
+	s := newDigestServer("auth")
+	s.challengeHeader = "X-WWW-Authenticate"
+	s.authorizationHeader = "X-Authorization"
+	err := testServerRequest(s, "GET", "",
+		WithChallengeHeader("x-www-authenticate"),
+		WithAuthorizationHeader("x-authorization"),
+	)
+	if err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestConnectUsesAuthority(t *testing.T) {
+	s := newDigestServer("auth")
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return params["uri"] == "example.com:443" && r.RequestURI == "example.com:443"
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest("CONNECT", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.URL.Opaque = "example.com:443"
+
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	if m := s.lastAuthorization(); m["uri"] != "example.com:443" {
+		t.Errorf("invalid uri: %s", m["uri"])
+	}
+}
+
+func TestChallengeInterceptor(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rawChallenge = fmt.Sprintf(`Digest realm="%s", nonce="%s", qop="auth"`, s.realm, s.nonce)
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return params["opaque"] == s.opaque
+	}
+
+	// the opaque is optional, so the challenge is answered without one
+	if err := testServerRequest(s, "GET", ""); err == nil {
+		t.Error("the server accepts no opaque")
+	}
+	if _, ok := s.lastAuthorization()["opaque"]; ok {
+		t.Errorf("an opaque the server did not send is sent: %+v", s.lastAuthorization())
+	}
+
+	err := testServerRequest(s, "GET", "", WithChallengeInterceptor(func(c *Challenge) {
+		if c.Opaque == "" {
+			c.Opaque = s.opaque
+		}
+	}))
+	if err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestDirectiveOrder(t *testing.T) {
+	s := newDigestServer("auth")
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return strings.HasPrefix(r.Header.Get(authorization), `Digest realm="example.com", username="john", `)
+	}
+	if err := testServerRequest(s, "GET", "", WithDirectiveOrder("realm", "username")); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestUnquotedURI(t *testing.T) {
+	s := newDigestServer("auth")
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return strings.Contains(r.Header.Get(authorization), ", uri=/path?q=1, ")
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+"/path?q=1", nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "john", "hello", WithIISCompat(), WithUnquotedURI()).Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+}
+
+func TestQuotedNC(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithQuotedNC()}} {
+		quoted := len(opts) > 0
+		s := newDigestServer("auth")
+		s.accept = func(r *http.Request, params map[string]string) bool {
+			return strings.Contains(r.Header.Get(authorization), `, nc="00000001", `) == quoted
+		}
+		if err := testServerRequest(s, "GET", "", opts...); err != nil {
+			t.Errorf("error in testServerRequest with quoted %t: %v", quoted, err)
+		}
+	}
+}
+
+func TestUppercaseNC(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithUppercaseNC())
+	for i := 0; i < 10; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet %d: %v", i, err)
+		}
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "0000000A" {
+		t.Errorf("invalid nc: %s", nc)
+	}
+}
+
+func TestOpaqueIsEchoedVerbatim(t *testing.T) {
+	s := newDigestServer("auth")
+	s.opaque = `5ccc\"069c, 403e `
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return strings.Contains(r.Header.Get(authorization), `opaque="5ccc\"069c, 403e "`)
+	}
+	if err := testServerRequest(s, "GET", ""); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(digestHandler)
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	tlsConfig := ts.Client().Transport.(*http.Transport).TLSClientConfig
+	r.client.Transport.(*http.Transport).TLSClientConfig = tlsConfig
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("not HTTP/2: %s", resp.Proto)
+	}
+}
+
+func redirectingServer(s *digestServer, other string) {
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/a":
+			http.Redirect(w, r, "/b", http.StatusFound)
+		case "/b":
+			fmt.Fprintf(w, "OK")
+		default:
+			http.Redirect(w, r, other, http.StatusTemporaryRedirect)
+		}
+	}
+}
+
+func testRedirect(s *digestServer, path string) (*http.Response, error) {
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL+path, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in NewRequest")
+	}
+	// a cookie which must not go to other hosts
+	req.Header.Set("Cookie", "session=secret")
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "error in Do")
+	}
+	_ = resp.Body.Close()
+	return resp, nil
+}
+
+func TestRedirectKeepsAuthentication(t *testing.T) {
+	s := newDigestServer("auth")
+	redirectingServer(s, "")
+	resp, err := testRedirect(s, "/a")
+	if err != nil {
+		t.Fatalf("error in testRedirect: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	// the probe, /a, /b
+	if n := s.requests(); n != 3 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	m := s.lastAuthorization()
+	if !strings.HasSuffix(m["uri"], "/b") || m["nc"] != "00000002" {
+		t.Errorf("invalid authorization for the redirect: %+v", m)
+	}
+}
+
+func TestRedirectOutOfDomainDropsCredentials(t *testing.T) {
+	var header, cookie string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(authorization)
+		cookie = r.Header.Get("Cookie")
+		fmt.Fprintf(w, "OK")
+	}))
+	defer other.Close()
+
+	s := newDigestServer("auth")
+	redirectingServer(s, other.URL)
+	if _, err := testRedirect(s, "/c"); err != nil {
+		t.Fatalf("error in testRedirect: %v", err)
+	}
+	if header != "" {
+		t.Errorf("credentials are sent to another origin: %s", header)
+	}
+	if cookie != "" {
+		t.Errorf("cookie is sent to another origin: %s", cookie)
+	}
+
+	s = newDigestServer("auth")
+	s.domain = "/c"
+	redirectingServer(s, "/b")
+	resp, err := testRedirect(s, "/c")
+	if err != nil {
+		t.Fatalf("error in testRedirect: %v", err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("credentials are sent out of the domain: %s", resp.Status)
+	}
+}
+
+func TestCredentialsFromUserinfo(t *testing.T) {
+	s := newDigestServer("auth")
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return !strings.Contains(params["uri"], "@")
+	}
+	basic := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, _, ok := r.BasicAuth(); ok {
+			basic = true
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", strings.Replace(ts.URL, "http://", "http://john:hello@", 1), nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "", "").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	if basic {
+		t.Errorf("userinfo is sent as basic authentication")
+	}
+	if u := s.lastAuthorization()["username"]; u != "john" {
+		t.Errorf("invalid username: %s", u)
+	}
+}
+
+func TestSetCredentials(t *testing.T) {
+	ts := httptest.NewServer(digestHandler)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "wrong")
+	do := func() (*http.Response, error) {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		return r.Do(req)
+	}
+
+	if _, err := do(); err == nil {
+		t.Fatalf("no error with a wrong password")
+	}
+
+	r.SetCredentials("john", "hello")
+	resp, err := do()
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+}
+
+func TestSetCredentialsConcurrently(t *testing.T) {
+	ts := httptest.NewServer(digestHandler)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			r.SetCredentials("john", "hello")
+		}()
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", ts.URL, nil)
+			if err != nil {
+				t.Errorf("error in NewRequest: %v", err)
+				return
+			}
+			resp, err := r.Do(req)
+			if err != nil {
+				t.Errorf("error in Do: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRangeRequestsReuseNonce(t *testing.T) {
+	content := "0123456789abcdefghij"
+	s := newDigestServer("auth")
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file", time.Time{}, strings.NewReader(content))
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	var got string
+	for i := 0; i < len(content); i += 8 {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", i, i+7))
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("error in ReadAll: %v", err)
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			t.Fatalf("error status code: %s", resp.Status)
+		}
+		got += string(b)
+	}
+
+	if got != content {
+		t.Errorf("invalid content: %s", got)
+	}
+	// a single probe and the three ranges
+	if n := s.requests(); n != 4 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestStreamingDownload(t *testing.T) {
+	chunk := strings.Repeat("x", 1<<20)
+	read := make(chan struct{})
+	var conns, downloads int32
+	s := newDigestServer("auth")
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, chunk)
+		w.(http.Flusher).Flush()
+		// the rest is sent only after the client has read the first chunk,
+		// and for the first download after the read/write timeout has passed
+		<-read
+		if atomic.AddInt32(&downloads, 1) == 1 {
+			time.Sleep(readWriteTimeout + 200*time.Millisecond)
+		}
+		fmt.Fprint(w, chunk)
+	}
+	ts := httptest.NewUnstartedServer(s)
+	ts.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.DoWithTimeout(req, 30*time.Second)
+		if err != nil {
+			t.Fatalf("error in DoWithTimeout: %v", err)
+		}
+		if _, err := io.ReadFull(resp.Body, make([]byte, len(chunk))); err != nil {
+			t.Fatalf("error in reading the first chunk: %v", err)
+		}
+		read <- struct{}{}
+		n, err := io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		if err != nil || n != int64(len(chunk)) {
+			t.Fatalf("error in reading the rest: %d bytes, %v", n, err)
+		}
+	}
+
+	// a single probe and the two downloads
+	if n := s.requests(); n != 3 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("the connection is not reused: %d connections", n)
+	}
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (c countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	atomic.AddInt64(c.n, int64(n))
+	return n, err
+}
+
+func TestExpectContinue(t *testing.T) {
+	s := newDigestServer("auth")
+	rotated := false
+	s.beforeCheck = func(params map[string]string) {
+		if !rotated {
+			rotated = true
+			s.rotateNonce(false)
+		}
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	content := strings.Repeat("x", 1<<20)
+	var sent []*int64
+	req, err := http.NewRequest("PUT", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		n := new(int64)
+		sent = append(sent, n)
+		return ioutil.NopCloser(countingReader{strings.NewReader(content), n}), nil
+	}
+	req.Body, _ = req.GetBody()
+	req.ContentLength = int64(len(content))
+	req.Header.Set("Expect", "100-continue")
+
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("error status code: %s", resp.Status)
+	}
+	if len(sent) != 2 || atomic.LoadInt64(sent[0]) != 0 || atomic.LoadInt64(sent[1]) != int64(len(content)) {
+		for i, n := range sent {
+			t.Errorf("body %d: %d bytes sent", i, atomic.LoadInt64(n))
+		}
+	}
+	if b := s.bodies[len(s.bodies)-1]; b != content {
+		t.Errorf("invalid body: %d bytes", len(b))
+	}
+}
+
+func TestSpacedQopList(t *testing.T) {
+	s := newDigestServer("auth, auth-int")
+	if err := testServerRequest(s, "POST", "hello world", WithPreferredQop("auth-int")); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	if q := s.lastAuthorization()["qop"]; q != "auth-int" {
+		t.Errorf("qop is not auth-int: %q", q)
+	}
+}
+
+func TestNextNonceResetsNonceCount(t *testing.T) {
+	s := newDigestServer("auth")
+	s.nextNonce = true
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("error status code: %s", resp.Status)
+		}
+		if nc := s.lastAuthorization()["nc"]; nc != "00000001" {
+			t.Errorf("nc is not reset for the next nonce: %s", nc)
+		}
+	}
+	// a single probe, and every request goes with the nonce handed out
+	if n := s.requests(); n != 4 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestStaleNonceResetsNonceCount(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for i := 0; i < 3; i++ {
+		if i == 2 {
+			s.rotateNonce(true)
+		}
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "00000001" {
+		t.Errorf("nc is not reset for the new nonce: %s", nc)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	s := newDigestServer("auth")
+	redirectingServer(s, "")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	client := &http.Client{Transport: New(context.Background(), "john", "hello")}
+	for _, path := range []string{"/a", "/b"} {
+		resp, err := client.Get(ts.URL + path)
+		if err != nil {
+			t.Fatalf("error in Get: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("error status code: %s", resp.Status)
+		}
+	}
+	// a single probe, then /a and /b for the redirect and /b again
+	if n := s.requests(); n != 4 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	if m := s.lastAuthorization(); m["nc"] != "00000003" {
+		t.Errorf("invalid nc: %s", m["nc"])
+	}
+}
+
+func TestRoundTripperConcurrently(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	client := &http.Client{Transport: New(context.Background(), "john", "hello")}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(ts.URL, "text/plain", strings.NewReader("body"))
+			if err != nil {
+				t.Errorf("error in Post: %v", err)
+				return
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("error status code: %s", resp.Status)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentRequestsHaveDistinctNonceCounts(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// one nonce for all of them
+	r := New(context.Background(), "john", "hello")
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	const n = 50
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := doGet(r, ts.URL); err != nil {
+				t.Errorf("error in doGet: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := s.requests(); got != n+2 {
+		t.Errorf("invalid number of requests: %d", got)
+	}
+	seen := make(map[string]bool)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.authorizations[1:] {
+		if m["nonce"] != s.nonce {
+			t.Errorf("invalid nonce: %s", m["nonce"])
+		}
+		if seen[m["nc"]] {
+			t.Errorf("nc %s is sent twice", m["nc"])
+		}
+		seen[m["nc"]] = true
+	}
+	if !seen[fmt.Sprintf("%08x", n+1)] {
+		t.Errorf("nc does not go up to %08x", n+1)
+	}
+}
+
+func TestResponseAuth(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rspauth = func(correct string) string { return correct }
+	if err := testServerRequest(s, "GET", ""); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+
+	s = newDigestServer("auth")
+	s.rspauth = func(correct string) string { return h(correct) }
+	err := testServerRequest(s, "GET", "")
+	if errors.Cause(err) != ErrInvalidResponseAuth {
+		t.Errorf("invalid rspauth is accepted: %v", err)
+	}
+}
+
+func TestStrictAuthenticationInfo(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		echo func(params map[string]string) []string
+		// err is the directive that mismatches, if any
+		err string
+	}{
+		{"echoed", func(p map[string]string) []string {
+			return []string{`qop=` + p["qop"], `cnonce="` + p["cnonce"] + `"`, `nc=` + strings.ToUpper(p["nc"])}
+		}, ""},
+		{"left out", func(p map[string]string) []string { return nil }, ""},
+		{"qop", func(p map[string]string) []string { return []string{`qop=auth-int`} }, "qop"},
+		{"cnonce", func(p map[string]string) []string { return []string{`cnonce="other"`} }, "cnonce"},
+		{"nc", func(p map[string]string) []string { return []string{`nc=00000002`} }, "nc"},
+	} {
+		s := newDigestServer("auth")
+		s.rspauth = func(correct string) string { return correct }
+		s.authInfo = tc.echo
+		err := testServerRequest(s, "GET", "", WithStrictAuthenticationInfo())
+		e, ok := errors.Cause(err).(*ResponseAuthError)
+		if tc.err == "" && err != nil || tc.err != "" && (!ok || e.Directive != tc.err) {
+			t.Errorf("%s: invalid error: %v", tc.name, err)
+		}
+		if ok && !errors.Is(err, ErrInvalidResponseAuth) {
+			t.Errorf("%s: error is not ErrInvalidResponseAuth", tc.name)
+		}
+
+		// not checked by default
+		if err := testServerRequest(s, "GET", ""); err != nil {
+			t.Errorf("%s: error without the option: %v", tc.name, err)
+		}
+	}
+}
+
+func TestPasswordIsRedacted(t *testing.T) {
+	r := New(context.Background(), "john", "hello")
+	for _, s := range []string{
+		fmt.Sprintf("%v", r),
+		fmt.Sprintf("%#v", r),
+		fmt.Sprintf("%+v", credentials{"john", "hello"}),
+		fmt.Sprintf("%#v", credentials{"john", "hello"}),
+	} {
+		if strings.Contains(s, "hello") {
+			t.Errorf("password is not redacted: %s", s)
+		}
+	}
+}
+
+func TestResponseAuthErrorIsRedacted(t *testing.T) {
+	e := &ResponseAuthError{Directive: cnonce, Sent: "34ce2dc63caa96f0", Received: "zzz"}
+	if m := e.Error(); strings.Contains(m, "34ce2dc63caa96f0") || strings.Contains(m, "zzz") {
+		t.Errorf("cnonce is not redacted: %s", m)
+	}
+	if e.Sent != "34ce2dc63caa96f0" || e.Received != "zzz" {
+		t.Errorf("invalid fields: %+v", e)
+	}
+	// the other directives are no secrets
+	e = &ResponseAuthError{Directive: nc, Sent: "00000001", Received: "00000002"}
+	if m := e.Error(); !strings.Contains(m, "00000001") || !strings.Contains(m, "00000002") {
+		t.Errorf("nc is redacted: %s", m)
+	}
+}
+
+func TestNewDefault(t *testing.T) {
+	ts := httptest.NewServer(newDigestServer("auth"))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := NewDefault("john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+}
+
+func TestWebDAVMethods(t *testing.T) {
+	const propfind = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><allprop/></propfind>`
+	for _, tc := range []struct {
+		method, body string
+	}{
+		{"PROPFIND", propfind},
+		{"REPORT", propfind},
+		{"MKCOL", ""},
+	} {
+		for _, qop := range []string{"auth", "auth-int"} {
+			s := newDigestServer(qop)
+			ts := httptest.NewServer(s)
+
+			// a reader without GetBody has to be buffered for the resend
+			req, err := http.NewRequest(tc.method, ts.URL, ioutil.NopCloser(strings.NewReader(tc.body)))
+			if err != nil {
+				t.Fatalf("error in NewRequest: %v", err)
+			}
+			req.Header.Set(contentType, "application/xml")
+			resp, err := New(context.Background(), "john", "hello", WithPreferredQop(qop)).Do(req)
+			if err != nil {
+				t.Fatalf("error in Do for %s with %s: %v", tc.method, qop, err)
+			}
+			_ = resp.Body.Close()
+			ts.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("error status code for %s with %s: %s", tc.method, qop, resp.Status)
+			}
+			if len(s.bodies) != 1 || s.bodies[0] != tc.body {
+				t.Errorf("invalid bodies for %s with %s: %q", tc.method, qop, s.bodies)
+			}
+		}
+	}
+}
+
+func TestNonceStats(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	u, _ := url.Parse(ts.URL)
+	if _, ok := r.NonceStats(u); ok {
+		t.Error("stats before any challenge")
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	stats, ok := r.NonceStats(u)
+	if !ok || stats.Uses != 3 || stats.FirstSeen.Before(start) {
+		t.Errorf("invalid stats: %+v, %v", stats, ok)
+	}
+
+	// a new nonce starts over
+	s.rotateNonce(true)
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if stats, _ := r.NonceStats(u); stats.Uses != 1 {
+		t.Errorf("invalid stats after the nonce changed: %+v", stats)
+	}
+}
+
+func TestNonceLifetime(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithNonceLifetime(time.Nanosecond))
+	for i := 0; i < 2; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	// every request is probed
+	if n := s.requests(); n != 4 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestNonceLifetimeSameNonce(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithNonceLifetime(100*time.Millisecond))
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	// the server hands out the same nonce again
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if n := r.Stats().RoundTrips; n != 2 {
+		t.Errorf("invalid number of round trips after the lifetime: %d", n)
+	}
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if n := r.Stats().RoundTrips; n != 1 {
+		t.Errorf("invalid number of round trips after the re-probe: %d", n)
+	}
+}
+
+func TestReprobeEvery(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithReprobeEvery(2))
+	var probes int
+	for i := 0; i < 7; i++ {
+		// a new nonce every time the server is probed
+		if i%3 == 0 {
+			s.rotateNonce(false)
+		}
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet %d: %v", i, err)
+		}
+		if r.Stats().RoundTrips == 2 {
+			probes++
+		}
+		// the nc of a new nonce starts over
+		if nc, want := s.lastAuthorization()["nc"], nonceCount(i%3+1).String(); nc != want {
+			t.Errorf("invalid nc of request %d: %s", i, nc)
+		}
+	}
+	// the first request, and every one after 2 reused the challenge
+	if probes != 3 {
+		t.Errorf("invalid number of probes: %d", probes)
+	}
+}
+
+func doGet(r *DigestRequest, u string) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return errors.Wrap(err, "error in NewRequest")
+	}
+	resp, err := r.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "error in Do")
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("error status code: %s", resp.Status)
+	}
+	return nil
+}
+
+func TestSuccessWithChallenge(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rspauth = func(correct string) string { return correct }
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(wwwAuthenticate, "Digest invalid")
+		fmt.Fprintf(w, "OK")
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// the second request is sent with the nonce of the first right away
+	r := New(context.Background(), "john", "hello")
+	for i := 0; i < 2; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	if n := s.requests(); n != 3 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+
+	// the probe is answered with a success and a challenge
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(wwwAuthenticate, "Digest invalid")
+		fmt.Fprintf(w, "OK")
+	}))
+	defer ts.Close()
+	if err := doGet(r, ts.URL); err != nil {
+		t.Errorf("error in doGet: %v", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	ts := httptest.NewServer(newDigestServer("auth"))
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	if s := r.String(); s != "DigestRequest{username:john}" {
+		t.Errorf("invalid String before a challenge: %s", s)
+	}
+	for i := 0; i < 2; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	if s := r.String(); s != "DigestRequest{username:john realm:example.com algorithm:MD5 qop:auth nc:00000002}" {
+		t.Errorf("invalid String: %s", s)
+	}
+
+	r = New(context.Background(), "john", "hello", WithMaskedUsername())
+	if s := r.String(); s != "DigestRequest{username:j***}" {
+		t.Errorf("invalid String with the masked username: %s", s)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	s := newDigestServer("auth")
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			fmt.Fprintf(w, "OK")
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		fmt.Fprintf(gz, "OK")
+		_ = gz.Close()
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// the body is decoded by the transport, or not compressed at all
+	for _, tc := range []struct {
+		opts         []Option
+		uncompressed bool
+	}{
+		{nil, true},
+		{[]Option{WithDisableCompression()}, false},
+	} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := New(context.Background(), "john", "hello", tc.opts...).Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatalf("error in ReadAll: %v", err)
+		}
+		if string(b) != "OK" || resp.Header.Get("Content-Encoding") != "" {
+			t.Errorf("invalid body with %d options: %q, %s", len(tc.opts), b, resp.Header.Get("Content-Encoding"))
+		}
+		if resp.Uncompressed != tc.uncompressed {
+			t.Errorf("invalid Uncompressed with %d options: %v", len(tc.opts), resp.Uncompressed)
+		}
+	}
+
+	// the transport of the caller is not modified
+	transport := &http.Transport{}
+	New(context.Background(), "john", "hello", WithRoundTripper(transport), WithDisableCompression())
+	if transport.DisableCompression {
+		t.Error("the transport given is modified")
+	}
+
+	// with Accept-Encoding set by the caller, the raw body is returned
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatalf("error in gzip.NewReader: %v", err)
+	}
+	if b, _ := ioutil.ReadAll(gz); string(b) != "OK" {
+		t.Errorf("invalid body: %q", b)
+	}
+}
+
+func TestRetryTransientErrors(t *testing.T) {
+	for _, tc := range []struct {
+		method   string
+		failures []int32
+		status   int
+		requests int
+	}{
+		// the probe and the authenticated request fail once each
+		{"GET", []int32{1, 3}, http.StatusOK, 4},
+		// a POST is probed again, but not sent again
+		{"POST", []int32{1, 3}, http.StatusServiceUnavailable, 3},
+		{"PUT", []int32{1, 3}, http.StatusOK, 4},
+	} {
+		s := newDigestServer("auth")
+		var n int32
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			i := atomic.AddInt32(&n, 1)
+			for _, f := range tc.failures {
+				if i == f {
+					http.Error(w, "Service Unavailable", http.StatusServiceUnavailable)
+					return
+				}
+			}
+			s.ServeHTTP(w, r)
+		}))
+
+		req, err := http.NewRequest(tc.method, ts.URL, strings.NewReader("body"))
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := New(context.Background(), "john", "hello", WithRetry(2, time.Millisecond)).Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		ts.Close()
+
+		if resp.StatusCode != tc.status {
+			t.Errorf("invalid status code for %s: %s", tc.method, resp.Status)
+		}
+		if int(n) != tc.requests {
+			t.Errorf("invalid number of requests for %s: %d", tc.method, n)
+		}
+	}
+}
+
+func TestRetryIsOptIn(t *testing.T) {
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("invalid status code: %s", resp.Status)
+	}
+	// the probe and the request sent without a challenge
+	if n != 2 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+}
+
+func TestNonIdempotentRequestsAreNotRetried(t *testing.T) {
+	s := newDigestServer("auth")
+	s.beforeCheck = func(params map[string]string) {
+		s.beforeCheck = nil
+		s.rotateNonce(false)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for _, method := range []string{"POST", "PATCH"} {
+		req, err := http.NewRequest(method, ts.URL, strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s is retried: %s", method, resp.Status)
+		}
+		s.rotateNonce(false)
+	}
+
+	// the next request answers the challenge of the rejection
+	if err := doGet(r, ts.URL); err != nil {
+		t.Errorf("error in doGet: %v", err)
+	}
+}
+
+func TestNonIdempotentRequestsAfterStaleNonce(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	post := func() int {
+		req, err := http.NewRequest("POST", ts.URL, strings.NewReader("hello world"))
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(); status != http.StatusOK {
+		t.Fatalf("invalid status: %d", status)
+	}
+
+	// the cached nonce expires; the server did not act on the rejected POST
+	s.rotateNonce(true)
+	n := s.requests()
+	if status := post(); status != http.StatusOK || s.requests()-n != 2 {
+		t.Errorf("status %d after %d requests", status, s.requests()-n)
+	}
+	if len(s.bodies) != 2 || s.bodies[1] != "hello world" {
+		t.Errorf("invalid bodies: %q", s.bodies)
+	}
+
+	// but only once
+	s.beforeCheck = func(params map[string]string) { s.rotateNonce(true) }
+	n = s.requests()
+	if status := post(); status != http.StatusUnauthorized || s.requests()-n != 2 {
+		t.Errorf("status %d after %d requests", status, s.requests()-n)
+	}
+}
+
+func TestStaleRetryReplaysBody(t *testing.T) {
+	content := "hello world"
+	for _, qop := range []string{"auth", "auth-int"} {
+		for _, getBody := range []bool{true, false} {
+			s := newDigestServer(qop)
+			// the first authorized request is answered with stale=true
+			s.beforeCheck = func(params map[string]string) {
+				s.beforeCheck = nil
+				s.rotateNonce(true)
+			}
+			ts := httptest.NewServer(s)
+
+			var body io.Reader = strings.NewReader(content)
+			if !getBody {
+				body = struct{ io.Reader }{body}
+			}
+			req, err := http.NewRequest("POST", ts.URL, body)
+			if err != nil {
+				t.Fatalf("error in NewRequest: %v", err)
+			}
+			resp, err := New(context.Background(), "john", "hello", WithNonIdempotentRetries()).Do(req)
+			if err != nil {
+				t.Fatalf("%s, GetBody %t: error in Do: %v", qop, getBody, err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || s.requests() != 3 {
+				t.Errorf("%s, GetBody %t: status %s after %d requests", qop, getBody, resp.Status, s.requests())
+			}
+			if len(s.bodies) != 1 || s.bodies[0] != content {
+				t.Errorf("%s, GetBody %t: invalid bodies: %q", qop, getBody, s.bodies)
+			}
+			ts.Close()
+		}
+	}
+}
+
+func TestProxyAuthentication(t *testing.T) {
+	s := newDigestServer("auth")
+	s.status = http.StatusProxyAuthRequired
+	s.challengeHeader = "Proxy-Authenticate"
+	s.authorizationHeader = "Proxy-Authorization"
+	opts := []Option{
+		WithChallengeHeader("Proxy-Authenticate"),
+		WithAuthorizationHeader("Proxy-Authorization"),
+	}
+	if err := testServerRequest(s, "GET", "", opts...); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+	// the codes given replace the default of the proxy too
+	all := append(opts, WithAuthStatusCodes(http.StatusUnauthorized))
+	if err := testServerRequest(s, "GET", "", all...); err == nil || !strings.Contains(err.Error(), "407") {
+		t.Errorf("407 is answered without being in WithAuthStatusCodes: %v", err)
+	}
+	all = append(opts, WithAuthStatusCodes(http.StatusUnauthorized, http.StatusProxyAuthRequired))
+	if err := testServerRequest(s, "GET", "", all...); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestAuthStatusCodes(t *testing.T) {
+	// a gateway sending its challenge with a 403
+	s := newDigestServer("auth")
+	s.status = http.StatusForbidden
+	if err := testServerRequest(s, "GET", ""); err == nil {
+		t.Error("403 is answered without WithAuthStatusCodes")
+	}
+	if err := testServerRequest(s, "GET", "", WithAuthStatusCodes(http.StatusForbidden)); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+}
+
+func TestUnexpectedRealmGetsNoCredentials(t *testing.T) {
+	s := newDigestServer("auth")
+	if err := testServerRequest(s, "GET", "", WithExpectedRealm("other")); err == nil {
+		t.Error("unexpected realm is answered")
+	}
+	// the probe only
+	if n := s.requests(); n != 1 || s.lastAuthorization() != nil {
+		t.Errorf("credentials are sent: %d, %+v", n, s.lastAuthorization())
+	}
+}
+
+func TestCredentialProvider(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rawChallenge = fmt.Sprintf(`Digest realm="other", nonce="n", opaque="o", qop="auth", `+
+		`Digest realm="%s", nonce="%s", opaque="%s", qop="auth"`, s.realm, s.nonce, s.opaque)
+	provider := func(realm string) (string, string, bool) {
+		if realm == s.realm {
+			return "john", "hello", true
+		}
+		return "", "", false
+	}
+	if err := testServerRequest(s, "GET", "", WithCredentialProvider(provider)); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+	if m := s.lastAuthorization(); m["realm"] != s.realm || m["username"] != "john" {
+		t.Errorf("invalid authorization: %+v", m)
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper made of a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithRoundTripper(t *testing.T) {
+	var methods []string
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		methods = append(methods, req.Method+" "+req.Header.Get(authorization))
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	s := newDigestServer("auth")
+	if err := testServerRequest(s, "GET", "", WithRoundTripper(rt)); err != nil {
+		t.Fatalf("error in testServerRequest: %v", err)
+	}
+	if len(methods) != 2 || methods[0] != "GET " || !strings.HasPrefix(methods[1], "GET Digest ") {
+		t.Errorf("invalid round trips: %q", methods)
+	}
+
+	// with a deadline too
+	methods = nil
+	ts := httptest.NewServer(newDigestServer("auth"))
+	defer ts.Close()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "john", "hello", WithRoundTripper(rt)).DoWithTimeout(req, time.Minute)
+	if err != nil {
+		t.Fatalf("error in DoWithTimeout: %v", err)
+	}
+	_ = resp.Body.Close()
+	if len(methods) != 2 {
+		t.Errorf("invalid round trips: %q", methods)
+	}
+}
+
+func TestEmptyPassword(t *testing.T) {
+	s := newDigestServer("auth")
+	s.password = ""
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if err := doGet(New(context.Background(), "john", ""), ts.URL); err != nil {
+		t.Errorf("error in doGet: %v", err)
+	}
+	if ha1 := md5Algorithm.sum([]string{"john", "example.com", ""}); ha1 != h("john:example.com:") {
+		t.Errorf("invalid HA1: %s", ha1)
+	}
+}
+
+func TestUsernameWithColon(t *testing.T) {
+	s := newDigestServer("auth")
+	s.username = "example:john"
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	if err := doGet(New(context.Background(), "example:john", "hello"), ts.URL); err != nil {
+		t.Errorf("error in doGet: %v", err)
+	}
+	if m := s.lastAuthorization(); m["username"] != "example:john" || m["userhash"] != "" {
+		t.Errorf("invalid authorization: %+v", m)
+	}
+
+	// with userhash, the username is sent hashed
+	s = newDigestServer("auth")
+	s.username = "example:john"
+	s.rawChallenge = fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s", qop="auth", userhash=true`, s.realm, s.nonce, s.opaque)
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return params["username"] == h("example:john:example.com") && params["userhash"] == "true"
+	}
+	ts = httptest.NewServer(s)
+	defer ts.Close()
+	if err := doGet(New(context.Background(), "example:john", "hello"), ts.URL); err != nil {
+		t.Errorf("error in doGet with userhash: %v", err)
+	}
+}
+
+func TestStatsRoundTrips(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	if c := r.LastChallenge(); c != nil {
+		t.Errorf("challenge before any request: %+v", c)
+	}
+	for i, want := range []int{2, 1} {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+		if n := r.Stats().RoundTrips; n != want {
+			t.Errorf("invalid round trips of request %d: %d", i, n)
+		}
+	}
+	// a stale retry
+	s.rotateNonce(true)
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if n := r.Stats().RoundTrips; n != 2 {
+		t.Errorf("invalid round trips of the stale retry: %d", n)
+	}
+	if c := r.LastChallenge(); c == nil || c.Nonce != s.nonce || c.Realm != s.realm {
+		t.Errorf("invalid last challenge: %+v", c)
+	}
+}
+
+func TestStatsAuthenticated(t *testing.T) {
+	ts := httptest.NewServer(newDigestServer("auth"))
+	defer ts.Close()
+	open := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "OK")
+	}))
+	defer open.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for _, tc := range []struct {
+		url           string
+		authenticated bool
+	}{
+		{ts.URL, true},
+		{open.URL, false},
+		{ts.URL, true},
+	} {
+		if err := doGet(r, tc.url); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+		if a := r.Stats().Authenticated; a != tc.authenticated {
+			t.Errorf("invalid Authenticated for %s: %t", tc.url, a)
+		}
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	s := newDigestServer("auth")
+	var agents []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents = append(agents, r.UserAgent())
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		header string
+		opts   []Option
+		want   string
+	}{
+		{"caller/1.0", nil, "caller/1.0"},
+		{"", []Option{WithUserAgent("default/1.0")}, "default/1.0"},
+		{"caller/1.0", []Option{WithUserAgent("default/1.0")}, "caller/1.0"},
+	} {
+		agents = nil
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		if tc.header != "" {
+			req.Header.Set("User-Agent", tc.header)
+		}
+		resp, err := New(context.Background(), "john", "hello", tc.opts...).Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if len(agents) != 2 || agents[0] != tc.want || agents[1] != tc.want {
+			t.Errorf("invalid User-Agent for %q: %q", tc.header, agents)
+		}
+	}
+}
+
+func TestWithHeader(t *testing.T) {
+	s := newDigestServer("auth")
+	var headers []http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = append(headers, r.Header)
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.Header.Set("Accept", "text/plain")
+	r := New(context.Background(), "john", "hello",
+		WithHeader("accept", "application/json"),
+		WithHeader("X-Api-Version", "2"),
+		WithHeader("X-Api-Version", "3"),
+	)
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// on the probe and the authorized request, unless the request has it
+	if len(headers) != 2 {
+		t.Fatalf("invalid number of requests: %d", len(headers))
+	}
+	for i, h := range headers {
+		if a := h.Get("Accept"); a != "text/plain" {
+			t.Errorf("invalid Accept of request %d: %s", i, a)
+		}
+		if v := h["X-Api-Version"]; strings.Join(v, ",") != "2,3" {
+			t.Errorf("invalid X-Api-Version of request %d: %q", i, v)
+		}
+	}
+}
+
+func TestProbeHeaders(t *testing.T) {
+	s := newDigestServer("auth")
+	// the nonce only holds for the Content-Type it was handed out for
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return r.Header.Get(contentType) == "application/json"
+	}
+	var probe http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(authorization) == "" {
+			if r.Header.Get(contentType) != "application/json" {
+				http.Error(w, "bad content type", http.StatusBadRequest)
+				return
+			}
+			probe = r.Header
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader(`{"name":"john"}`))
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.Header.Set(contentType, "application/json")
+	req.Header.Set(contentEncoding, "identity")
+	req.Header.Set("X-Request-Id", "42")
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("invalid status: %s", resp.Status)
+	}
+	if probe == nil || probe.Get("X-Request-Id") != "42" {
+		t.Errorf("invalid headers of the probe: %v", probe)
+	}
+	// the probe has no body to describe
+	if _, ok := probe[contentEncoding]; ok {
+		t.Errorf("the probe has %s", contentEncoding)
+	}
+	if len(s.bodies) != 1 || s.bodies[0] != `{"name":"john"}` {
+		t.Errorf("invalid bodies: %q", s.bodies)
+	}
+}
+
+func TestHostStats(t *testing.T) {
+	a := newDigestServer("auth")
+	b := newDigestServer("auth")
+	b.realm = "b.example.com"
+	b.rotateNonce(false)
+	tsA := httptest.NewServer(a)
+	defer tsA.Close()
+	tsB := httptest.NewServer(b)
+	defer tsB.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for _, u := range []string{tsA.URL, tsB.URL, tsA.URL} {
+		if err := doGet(r, u); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	stats := r.HostStats()
+	if len(stats) != 2 {
+		t.Fatalf("invalid number of hosts: %+v", stats)
+	}
+	if s := stats[tsA.URL]; s.Realm != a.realm || s.Nonce != a.nonce || s.NC != "00000002" {
+		t.Errorf("invalid stats of %s: %+v", tsA.URL, s)
+	}
+	if s := stats[tsB.URL]; s.Realm != b.realm || s.Nonce != b.nonce || s.NC != "00000001" {
+		t.Errorf("invalid stats of %s: %+v", tsB.URL, s)
+	}
+}
+
+func TestNonceCountAcrossHosts(t *testing.T) {
+	a := newDigestServer("auth")
+	b := newDigestServer("auth")
+	b.rotateNonce(false)
+	tsA := httptest.NewServer(a)
+	defer tsA.Close()
+	tsB := httptest.NewServer(b)
+	defer tsB.Close()
+
+	r := New(context.Background(), "john", "hello")
+	for i, tc := range []struct {
+		s      *digestServer
+		u      string
+		rotate bool
+		nc     string
+	}{
+		{a, tsA.URL, false, "00000001"},
+		{b, tsB.URL, false, "00000001"},
+		{a, tsA.URL, false, "00000002"},
+		{b, tsB.URL, false, "00000002"},
+		// a new nonce of one host starts over, and leaves the other be
+		{a, tsA.URL, true, "00000001"},
+		{b, tsB.URL, false, "00000003"},
+	} {
+		if tc.rotate {
+			tc.s.rotateNonce(false)
+		}
+		if err := doGet(r, tc.u); err != nil {
+			t.Fatalf("error in doGet %d: %v", i, err)
+		}
+		if nc := tc.s.lastAuthorization()["nc"]; nc != tc.nc {
+			t.Errorf("invalid nc of request %d: %s", i, nc)
+		}
+	}
+}
+
+func TestNonceCountSequence(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	get := func() {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	get()
+	get()
+	get()
+	first := s.nonce
+	// a new nonce starts at 1
+	s.rotateNonce(true)
+	get()
+	get()
+	// the first nonce comes back, and SetCredentials does not make its nc
+	// start over either
+	s.mu.Lock()
+	s.nonce = first
+	s.mu.Unlock()
+	r.SetCredentials("john", "hello")
+	get()
+
+	var got []string
+	for _, m := range s.authorizations {
+		if m != nil {
+			got = append(got, m["nc"])
+		}
+	}
+	// the 4th is rejected as stale
+	want := []string{"00000001", "00000002", "00000003", "00000004", "00000001", "00000002", "00000005"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("invalid nc sequence: %v", got)
+	}
+}
+
+func TestNonceCountWraparound(t *testing.T) {
+	if nc := nonceCount(maxNonceCount).String(); nc != "ffffffff" {
+		t.Errorf("invalid last nc: %s", nc)
+	}
+
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	exhaust := func() {
+		sess := r.sessions.lastUsed()
+		sess.mu.Lock()
+		sess.nonceCount = maxNonceCount - 1
+		sess.mu.Unlock()
+	}
+	exhaust()
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet with the last nc: %v", err)
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "ffffffff" || r.Stats().RoundTrips != 1 {
+		t.Errorf("invalid nc %s after %d round trips", nc, r.Stats().RoundTrips)
+	}
+
+	// the nonce is probed for anew instead of sending nc 00000000
+	s.rotateNonce(false)
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet after the last nc: %v", err)
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "00000001" || r.Stats().RoundTrips != 2 {
+		t.Errorf("invalid nc %s after %d round trips", nc, r.Stats().RoundTrips)
+	}
+
+	// a server handing out the exhausted nonce again cannot be answered
+	sess := r.sessions.lastUsed()
+	sess.mu.Lock()
+	sess.nonceCount = maxNonceCount
+	sess.mu.Unlock()
+	if err := doGet(r, ts.URL); errors.Cause(err) != ErrNonceExhausted {
+		t.Errorf("invalid error: %v", err)
+	}
+}
+
+func TestRealmChange(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	passwords := map[string]string{"example.com": "hello", "other.example.com": "world"}
+	var realms []string
+	r := New(context.Background(), "", "", WithCredentialProvider(func(realm string) (string, string, bool) {
+		realms = append(realms, realm)
+		p, ok := passwords[realm]
+		return "john", p, ok
+	}))
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+
+	// the server is reconfigured with another realm and forgets the nonce
+	s.mu.Lock()
+	s.realm = "other.example.com"
+	s.password = "world"
+	s.mu.Unlock()
+	s.rotateNonce(false)
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet after the realm changed: %v", err)
+	}
+	if m := s.lastAuthorization(); m["realm"] != "other.example.com" {
+		t.Errorf("invalid realm: %+v", m)
+	}
+	if last := realms[len(realms)-1]; last != "other.example.com" {
+		t.Errorf("credentials are not looked up for the new realm: %q", realms)
+	}
+}
+
+func TestReadWriteTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "O")
+		w.(http.Flusher).Flush()
+		time.Sleep(300 * time.Millisecond)
+		fmt.Fprintf(w, "K")
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		timeout time.Duration
+		ok      bool
+	}{
+		{100 * time.Millisecond, false},
+		{0, true},
+	} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := New(context.Background(), "john", "hello", WithReadWriteTimeout(tc.timeout)).Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if (err == nil && string(b) == "OK") != tc.ok {
+			t.Errorf("invalid result with the timeout %v: %q, %v", tc.timeout, b, err)
+		}
+	}
+}
+
+func TestVirtualHost(t *testing.T) {
+	s := newDigestServer("auth")
+	var hosts []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts = append(hosts, r.Host)
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req.Host = "vhost.example.com"
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if len(hosts) != 2 || hosts[0] != req.Host || hosts[1] != req.Host {
+		t.Errorf("invalid hosts: %q", hosts)
+	}
+}
+
+func TestProbeMethod(t *testing.T) {
+	s := newDigestServer("auth")
+	var methods []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "john", "hello", WithProbeMethod("HEAD")).Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+	if strings.Join(methods, ",") != "HEAD,POST" {
+		t.Errorf("invalid methods: %q", methods)
+	}
+}
+
+func TestHA2HasTheRequestMethod(t *testing.T) {
+	for _, probe := range []string{"", "OPTIONS", "HEAD"} {
+		s := newDigestServer("auth")
+		var authorized map[string]string
+		s.beforeCheck = func(params map[string]string) { authorized = params }
+		if err := testServerRequest(s, "PUT", "hello world", WithProbeMethod(probe)); err != nil {
+			t.Fatalf("error in testServerRequest with the probe %q: %v", probe, err)
+		}
+		if authorized["response"] != s.expectedResponse("PUT", authorized, nil) {
+			t.Errorf("response is not computed with PUT for the probe %q", probe)
+		}
+		if probe != "" && authorized["response"] == s.expectedResponse(probe, authorized, nil) {
+			t.Errorf("response is computed with the probe %q", probe)
+		}
+	}
+}
+
+func TestAuthorizationFromResponse(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("error in Get: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	r := New(context.Background(), "john", "hello")
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	auth, err := r.AuthorizationFromResponse(req, resp)
+	if err != nil {
+		t.Fatalf("error in AuthorizationFromResponse: %v", err)
+	}
+	req.Header.Set(authorization, auth)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code: %s", resp.Status)
+	}
+
+	// the challenge is reused without a probe
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if n := r.Stats().RoundTrips; n != 1 {
+		t.Errorf("invalid round trips: %d", n)
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "00000002" {
+		t.Errorf("invalid nc: %s", nc)
+	}
+}
+
+func TestProbeBody(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only requests with a body are gated
+		b, _ := ioutil.ReadAll(r.Body)
+		if len(b) == 0 && r.Header.Get(authorization) == "" {
+			fmt.Fprintf(w, "OK")
+			return
+		}
+		r.Body = ioutil.NopCloser(strings.NewReader(string(b)))
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for _, tc := range []struct {
+		opts   []Option
+		status int
+	}{
+		{nil, http.StatusUnauthorized},
+		{[]Option{WithProbeBody()}, http.StatusOK},
+	} {
+		req, err := http.NewRequest("POST", ts.URL, ioutil.NopCloser(strings.NewReader("hello world")))
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := New(context.Background(), "john", "hello", tc.opts...).Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("invalid status code with %d options: %s", len(tc.opts), resp.Status)
+		}
+	}
+	if b := s.bodies[len(s.bodies)-1]; b != "hello world" {
+		t.Errorf("invalid body: %q", b)
+	}
+}
+
+func TestProbeBodyIsNotSentAgain(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer ts.Close()
+
+	req, err := http.NewRequest("POST", ts.URL, strings.NewReader("hello world"))
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	r := New(context.Background(), "john", "hello", WithProbeBody())
+	resp, err := r.Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("invalid status: %s", resp.Status)
+	}
+	// the probe of an open server is the request
+	if len(bodies) != 1 || bodies[0] != "hello world" {
+		t.Errorf("invalid bodies: %q", bodies)
+	}
+	if n := r.Stats().RoundTrips; n != 1 {
+		t.Errorf("invalid round trips: %d", n)
+	}
+}
+
+func TestDoPreauthorized(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	c := &Challenge{Realm: s.realm, Nonce: s.nonce, Opaque: s.opaque, Qop: "auth"}
+	for i, nc := range []string{"00000001", "00000002"} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.DoPreauthorized(req, c)
+		if err != nil {
+			t.Fatalf("error in DoPreauthorized: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || r.Stats().RoundTrips != 1 {
+			t.Errorf("invalid result of request %d: %s, %+v", i, resp.Status, r.Stats())
+		}
+		if m := s.lastAuthorization(); m["nc"] != nc {
+			t.Errorf("invalid nc of request %d: %s", i, m["nc"])
+		}
+	}
+
+	// an outdated challenge falls back to the one of the rejection
+	s.rotateNonce(false)
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := r.DoPreauthorized(req, c)
+	if err != nil {
+		t.Fatalf("error in DoPreauthorized: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || r.Stats().RoundTrips != 2 {
+		t.Errorf("invalid result of the fallback: %s, %+v", resp.Status, r.Stats())
+	}
+
+	if _, err := r.DoPreauthorized(req, &Challenge{Realm: s.realm}); err == nil {
+		t.Error("invalid challenge is accepted")
+	}
+}
+
+func TestOpaqueIsReusedVerbatim(t *testing.T) {
+	s := newDigestServer("auth")
+	s.opaque = `5ccc\"069c, 403e `
+	var opaque string
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return strings.Contains(r.Header.Get(authorization), fmt.Sprintf(`opaque="%s"`, opaque))
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello")
+	opaque = s.opaque
+	for i := 0; i < 3; i++ {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet: %v", err)
+		}
+	}
+	if n := s.requests(); n != 4 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+
+	// a new opaque with the same nonce replaces the one kept
+	s.opaque = `new\\opaque`
+	opaque = s.opaque
+	for i, want := range []int{2, 1} {
+		if err := doGet(r, ts.URL); err != nil {
+			t.Fatalf("error in doGet with the new opaque: %v", err)
+		}
+		if n := r.Stats().RoundTrips; n != want {
+			t.Errorf("invalid round trips of request %d with the new opaque: %d", i, n)
+		}
+	}
+	if c := r.LastChallenge(); c.Opaque != `new\\opaque` {
+		t.Errorf("invalid opaque kept: %s", c.Opaque)
+	}
+}
+
+func TestWindowsSchemes(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add(wwwAuthenticate, "Negotiate")
+		w.Header().Add(wwwAuthenticate, "NTLM")
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	if err := doGet(New(context.Background(), "john", "hello"), ts.URL); err != nil {
+		t.Errorf("error in doGet: %v", err)
+	}
+}
+
+func TestLegacyServer(t *testing.T) {
+	if err := testServerRequest(newDigestServer(""), "GET", ""); err != nil {
+		t.Errorf("error in testServerRequest: %v", err)
+	}
+	err := testServerRequest(newDigestServer(""), "GET", "", WithPreferredQop("auth"), WithStrictQop())
+	if err == nil {
+		t.Error("server without qop is answered in strict mode")
+	}
+	// strict mode is about the preferred qop only
+	if err := testServerRequest(newDigestServer(""), "GET", "", WithStrictQop()); err != nil {
+		t.Errorf("error in strict mode without a preferred qop: %v", err)
+	}
+}
+
+func TestContextWithCredentials(t *testing.T) {
+	ts := httptest.NewServer(newDigestServer("auth"))
+	defer ts.Close()
+
+	ctx := ContextWithCredentials(context.Background(), "john", "hello")
+	if err := doGet(New(ctx, "", ""), ts.URL); err != nil {
+		t.Errorf("error in doGet with the context of New: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	resp, err := New(context.Background(), "", "").Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("error status code with the request context: %s", resp.Status)
+	}
+
+	// explicit credentials come first
+	if err := doGet(New(ContextWithCredentials(context.Background(), "john", "wrong"), "john", "hello"), ts.URL); err != nil {
+		t.Errorf("error in doGet with explicit credentials: %v", err)
+	}
+}
+
+func TestRejectionBody(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithRejectionBody(5))
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if b := string(r.LastChallenge().Body); b != "Unaut" {
+		t.Errorf("invalid body: %q", b)
+	}
+
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(wwwAuthenticate, `Digest realm="example.com"`)
+		http.Error(w, "account locked", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	err := doGet(New(context.Background(), "john", "hello", WithRejectionBody(1024)), ts.URL)
+	if e, ok := errors.Cause(err).(*ChallengeError); !ok || !strings.Contains(string(e.Body), "account locked") {
+		t.Errorf("invalid error: %#v", err)
+	}
+}
+
+func TestChallengeErrorHasResponse(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "weird/1.0")
+		w.Header().Set(wwwAuthenticate, r.URL.Query().Get("challenge"))
+		http.Error(w, "no", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	err := doGet(New(context.Background(), "john", "hello"), ts.URL+"?challenge="+url.QueryEscape(`Digest realm="example.com"`))
+	e, ok := errors.Cause(err).(*ChallengeError)
+	if !ok {
+		t.Fatalf("invalid error: %v", err)
+	}
+	if e.StatusCode != http.StatusUnauthorized || e.Status != "401 Unauthorized" || e.Header.Get("Server") != "weird/1.0" || e.Body != nil {
+		t.Errorf("invalid error: %#v", e)
+	}
+
+	err = doGet(New(context.Background(), "john", "hello"), ts.URL+"?challenge=Basic")
+	var se *SchemeError
+	if !errors.As(err, &se) || se.Schemes[0] != "Basic" {
+		t.Errorf("invalid error: %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	s := newDigestServer("auth")
+	var n int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&n, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	// the backoff is ignored for Retry-After
+	start := time.Now()
+	if err := doGet(New(context.Background(), "john", "hello", WithRetry(1, time.Hour)), ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if d := time.Since(start); d < time.Second || d > 10*time.Second {
+		t.Errorf("invalid wait: %v", d)
+	}
+
+	// the wait ends with the context
+	atomic.StoreInt32(&n, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	if _, err := New(context.Background(), "john", "hello", WithRetry(1, time.Hour)).Do(req.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("invalid error: %v", err)
+	}
+}
+
+func TestRetryAfterValues(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		d      time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"86400", maxRetryAfter, true},
+		{"soon", 0, false},
+		{time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat), 0, true},
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		if tc.header != "" {
+			resp.Header.Set("Retry-After", tc.header)
+		}
+		if d, ok := retryAfter(resp); d != tc.d || ok != tc.ok {
+			t.Errorf("invalid wait for %q: %v, %v", tc.header, d, ok)
+		}
+	}
+}
+
+func TestDoer(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	for _, d := range []Doer{New(context.Background(), "john", "hello"), &http.Client{Transport: NewDefault("john", "hello")}} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := d.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("error status code: %s", resp.Status)
+		}
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	for _, alg := range []string{"MD5", "SHA-256", "sha-256", "SHA-512-256"} {
+		for _, qop := range []string{"auth", "auth-int", ""} {
+			s := newDigestServer(qop)
+			s.algorithm = alg
+			s.rspauth = func(correct string) string { return correct }
+			if err := testServerRequest(s, "POST", "hello world"); err != nil {
+				t.Errorf("error with %s and qop %q: %v", alg, qop, err)
+			}
+			if a := s.lastAuthorization()["algorithm"]; a != alg {
+				t.Errorf("invalid algorithm echoed: %s", a)
+			}
+		}
+	}
+}
+
+func TestClientTrace(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var conns, wrote int32
+	trace := &httptrace.ClientTrace{
+		GotConn:      func(httptrace.GotConnInfo) { atomic.AddInt32(&conns, 1) },
+		WroteRequest: func(httptrace.WroteRequestInfo) { atomic.AddInt32(&wrote, 1) },
+	}
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	resp, err := New(context.Background(), "john", "hello").Do(req)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	// the probe and the authorized request
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Errorf("invalid connections traced: %d", n)
+	}
+	if n := atomic.LoadInt32(&wrote); n != 2 {
+		t.Errorf("invalid requests traced: %d", n)
+	}
+}
+
+// resetListener resets the first connections it accepts, as many as resets,
+// once their request is read, as a flaky network does
+type resetListener struct {
+	net.Listener
+	resets int32
+}
+
+func (l *resetListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil || atomic.AddInt32(&l.resets, -1) < 0 {
+			return c, err
+		}
+		_, _ = c.Read(make([]byte, 1024))
+		_ = c.(*net.TCPConn).SetLinger(0)
+		_ = c.Close()
+	}
+}
+
+func TestProbeConnectionReset(t *testing.T) {
+	for _, tc := range []struct {
+		resets int32
+		ok     bool
+	}{
+		{0, true},
+		{maxConnRetries, true},
+		{maxConnRetries + 1, false},
+	} {
+		s := newDigestServer("auth")
+		ts := httptest.NewUnstartedServer(s)
+		l := &resetListener{Listener: ts.Listener, resets: tc.resets}
+		ts.Listener = l
+		ts.Start()
+
+		r := New(context.Background(), "john", "hello")
+		err := doGet(r, ts.URL)
+		if tc.ok && err != nil {
+			t.Errorf("error in doGet after %d resets: %v", tc.resets, err)
+		} else if !tc.ok && err == nil {
+			t.Errorf("no error after %d resets", tc.resets)
+		}
+		// the server sees the probe once, and a rejection is not retried
+		if tc.ok && s.requests() != 2 {
+			t.Errorf("invalid number of requests after %d resets: %d", tc.resets, s.requests())
+		}
+		ts.Close()
+	}
+}
+
+func TestForbiddenError(t *testing.T) {
+	s := newDigestServer("auth")
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no rights", http.StatusForbidden)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	// a plain response by default
+	if err := doGet(New(context.Background(), "john", "hello"), ts.URL); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("invalid error: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	_, err = New(context.Background(), "john", "hello", WithForbiddenError()).Do(req)
+	e, ok := err.(*ForbiddenError)
+	if !ok {
+		t.Fatalf("invalid error: %v", err)
+	}
+	defer func() { _ = e.Response.Body.Close() }()
+	if b, _ := ioutil.ReadAll(e.Response.Body); strings.TrimSpace(string(b)) != "no rights" {
+		t.Errorf("invalid body: %q", b)
+	}
+	if !errors.Is(err, ErrForbidden) {
+		t.Error("error is not ErrForbidden")
+	}
+
+	// wrong credentials are still told apart
+	s.password = "wrong"
+	req, err = http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	if _, err := New(context.Background(), "john", "hello", WithForbiddenError()).Do(req); errors.Is(err, ErrForbidden) {
+		t.Errorf("invalid error for wrong credentials: %v", err)
+	}
+}
+
+func TestCheckAuth(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if err := New(context.Background(), "john", "hello").CheckAuth(ts.URL); err != nil {
+		t.Errorf("error for right credentials: %v", err)
+	}
+	err := New(context.Background(), "john", "wrong").CheckAuth(ts.URL)
+	if _, ok := errors.Cause(err).(*RetryError); !ok {
+		t.Errorf("invalid error for wrong credentials: %v", err)
+	}
+
+	open := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer open.Close()
+	if err := New(context.Background(), "john", "hello").CheckAuth(open.URL); err != ErrNoChallenge {
+		t.Errorf("invalid error for an open server: %v", err)
+	}
+
+	closed := httptest.NewServer(s)
+	closed.Close()
+	if err := New(context.Background(), "john", "hello").CheckAuth(closed.URL); err == nil {
+		t.Error("no error for a closed server")
+	}
+}
+
+func TestCheckAuthRejections(t *testing.T) {
+	s := newDigestServer("auth")
+	status := http.StatusUnauthorized
+	// a rejection without a challenge to retry with
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no", status)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	err := New(context.Background(), "john", "hello").CheckAuth(ts.URL)
+	if e, ok := err.(*RejectedError); !ok || e.StatusCode != http.StatusUnauthorized {
+		t.Errorf("invalid error for a rejection: %v", err)
+	}
+
+	status = http.StatusForbidden
+	err = New(context.Background(), "john", "hello", WithForbiddenError()).CheckAuth(ts.URL)
+	e, ok := err.(*ForbiddenError)
+	if !ok {
+		t.Fatalf("invalid error for a 403: %v", err)
+	}
+	if _, err := e.Response.Body.Read(make([]byte, 1)); err == nil {
+		t.Error("the body of the response is not closed")
+	}
+}
+
+func TestWebSocketAuthorization(t *testing.T) {
+	s := newDigestServer("auth")
+	s.accept = func(r *http.Request, params map[string]string) bool {
+		return r.Header.Get("Upgrade") == "websocket"
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/socket?v=1"
+
+	// the handshake a dialer tries first
+	handshake := func(auth string) *http.Response {
+		req, err := http.NewRequest("GET", ts.URL+"/socket?v=1", nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Connection", "Upgrade")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		discardBody(resp)
+		return resp
+	}
+	resp := handshake("")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("invalid status: %s", resp.Status)
+	}
+
+	r := New(context.Background(), "john", "hello")
+	req, err := http.NewRequest("GET", wsURL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	auth, err := r.AuthorizationFromResponse(req, resp)
+	if err != nil {
+		t.Fatalf("error in AuthorizationFromResponse: %v", err)
+	}
+	if p := parseAuthorization(auth); p["uri"] != wsURL {
+		t.Errorf("invalid uri: %q", p["uri"])
+	}
+	if resp := handshake(auth); resp.StatusCode != http.StatusOK {
+		t.Errorf("invalid status: %s", resp.Status)
+	}
+
+	// the session is shared with http
+	apiReq, err := http.NewRequest("GET", ts.URL+"/socket?v=1", nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	apiReq.Header.Set("Upgrade", "websocket")
+	n := s.requests()
+	resp, err = r.Do(apiReq)
+	if err != nil {
+		t.Fatalf("error in Do: %v", err)
+	}
+	discardBody(resp)
+	if resp.StatusCode != http.StatusOK || s.requests() != n+1 {
+		t.Errorf("status %s after %d requests", resp.Status, s.requests()-n)
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "00000002" {
+		t.Errorf("invalid nc: %s", nc)
+	}
+}
+
+func TestAuthMode(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	get := func(r *DigestRequest) int {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		resp, err := r.Do(req)
+		if err != nil {
+			t.Fatalf("error in Do: %v", err)
+		}
+		discardBody(resp)
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		name string
+		mode AuthMode
+		// known gives the current challenge to WithAuthMode, which is outdated
+		// by rotate
+		known, rotate bool
+		// the status and requests of two requests in a row
+		status   [2]int
+		requests [2]int
+	}{
+		{"probe first", AuthProbeFirst, true, false, [2]int{200, 200}, [2]int{2, 1}},
+		{"preemptive", AuthPreemptive, true, false, [2]int{200, 200}, [2]int{1, 1}},
+		{"preemptive with outdated challenge", AuthPreemptive, true, true, [2]int{200, 200}, [2]int{2, 1}},
+		{"preemptive without challenge", AuthPreemptive, false, false, [2]int{200, 200}, [2]int{2, 1}},
+		{"preemptive only", AuthPreemptiveOnly, true, false, [2]int{200, 200}, [2]int{1, 1}},
+		{"preemptive only with outdated challenge", AuthPreemptiveOnly, true, true, [2]int{401, 200}, [2]int{1, 1}},
+		{"preemptive only without challenge", AuthPreemptiveOnly, false, false, [2]int{401, 200}, [2]int{1, 1}},
+	} {
+		var c *Challenge
+		if tc.known {
+			c = &Challenge{Realm: s.realm, Nonce: s.nonce, Opaque: s.opaque, Qop: "auth"}
+		}
+		if tc.rotate {
+			s.rotateNonce(false)
+		}
+		r := New(context.Background(), "john", "hello", WithAuthMode(tc.mode, c))
+		for i := range tc.status {
+			n := s.requests()
+			if status := get(r); status != tc.status[i] || s.requests()-n != tc.requests[i] {
+				t.Errorf("%s: request %d: status %d after %d requests", tc.name, i, status, s.requests()-n)
+			}
+		}
+	}
+
+	// an invalid challenge fails the request
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	if _, err := New(context.Background(), "john", "hello", WithAuthMode(AuthPreemptive, &Challenge{})).Do(req); err == nil {
+		t.Error("no error for an invalid challenge")
+	}
+}
+
+func TestDefaultRealm(t *testing.T) {
+	s := newDigestServer("auth")
+	s.rawChallenge = fmt.Sprintf(`Digest nonce="%s", opaque="%s", qop="auth"`, s.nonce, s.opaque)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	if err := doGet(New(context.Background(), "john", "hello"), ts.URL); !errors.Is(err, ErrMissingRealm) {
+		t.Errorf("invalid error: %v", err)
+	}
+	if err := doGet(New(context.Background(), "john", "hello", WithDefaultRealm(s.realm)), ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if m := s.lastAuthorization(); m["realm"] != s.realm {
+		t.Errorf("invalid realm: %q", m["realm"])
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, err := http.NewRequest("GET", ts.URL, nil)
+	if err != nil {
+		t.Fatalf("error in NewRequest: %v", err)
+	}
+	if _, err := New(ctx, "john", "hello").Do(req); err != context.Canceled {
+		t.Errorf("invalid error for the context of New: %v", err)
+	}
+	if _, err := New(context.Background(), "john", "hello").Do(req.WithContext(ctx)); err != context.Canceled {
+		t.Errorf("invalid error for the context of the request: %v", err)
+	}
+	if n := s.requests(); n != 0 {
+		t.Errorf("%d requests are sent", n)
+	}
+}
+
+func TestHelpers(t *testing.T) {
+	s := newDigestServer("auth")
+	var paths []string
+	s.authorized = func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path+" "+r.Header.Get("Content-Type"))
+		fmt.Fprint(w, "OK")
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithBaseURL(ts.URL+"/api/"))
+	for _, do := range []func() (*http.Response, error){
+		func() (*http.Response, error) { return r.Get("/v1/status") },
+		func() (*http.Response, error) { return r.Head("v1/status") },
+		func() (*http.Response, error) { return r.Post("v1/items", "application/json", strings.NewReader(`{}`)) },
+		func() (*http.Response, error) { return r.Get(ts.URL + "/other") },
+	} {
+		resp, err := do()
+		if err != nil {
+			t.Fatalf("error in request: %v", err)
+		}
+		discardBody(resp)
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("invalid status: %s", resp.Status)
+		}
+	}
+	expected := []string{
+		"GET /api/v1/status ",
+		"HEAD /api/v1/status ",
+		"POST /api/v1/items application/json",
+		"GET /other ",
+	}
+	if strings.Join(paths, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("invalid requests: %q", paths)
+	}
+	if s.bodies[len(s.bodies)-2] != `{}` {
+		t.Errorf("invalid body: %q", s.bodies[len(s.bodies)-2])
+	}
+}
+
+func TestPinnedPublicKeys(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewTLSServer(s)
+	defer ts.Close()
+	transport := ts.Client().Transport.(*http.Transport)
+	// sessions resumed from the cache are checked too
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(8)
+	pin := publicKeyPin(ts.Certificate())
+	other := publicKeyPin(&x509.Certificate{RawSubjectPublicKeyInfo: []byte("other")})
+
+	if err := doGet(New(context.Background(), "john", "hello", WithRoundTripper(transport), WithPinnedPublicKeys(other, pin)), ts.URL); err != nil {
+		t.Errorf("error for a pinned key: %v", err)
+	}
+	n := s.requests()
+	err := doGet(New(context.Background(), "john", "hello", WithRoundTripper(transport), WithPinnedPublicKeys(other)), ts.URL)
+	if !errors.Is(err, ErrUnpinnedCertificate) {
+		t.Errorf("invalid error for another key: %v", err)
+	}
+	if s.requests() != n {
+		t.Error("a request is sent to a server with another key")
+	}
+	if transport.TLSClientConfig.VerifyConnection != nil {
+		t.Error("the transport given is modified")
+	}
+
+	// a check of the caller still runs
+	checked := transport.Clone()
+	checked.TLSClientConfig.VerifyConnection = func(tls.ConnectionState) error { return errors.New("refused") }
+	err = doGet(New(context.Background(), "john", "hello", WithRoundTripper(checked), WithPinnedPublicKeys(pin)), ts.URL)
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("invalid error for the check of the caller: %v", err)
+	}
+
+	// a round tripper which cannot be pinned fails closed
+	rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) { return transport.RoundTrip(req) })
+	r := New(context.Background(), "john", "hello", WithRoundTripper(rt), WithPinnedPublicKeys(pin))
+	if err := doGet(r, ts.URL); errors.Cause(err) != ErrPinningUnsupported {
+		t.Errorf("invalid error for a round tripper: %v", err)
+	}
+	if err := r.Warm(context.Background(), ts.URL); err != ErrPinningUnsupported {
+		t.Errorf("invalid error of Warm for a round tripper: %v", err)
+	}
+	if s.requests() != n {
+		t.Error("a request is sent through a round tripper which cannot be pinned")
+	}
+}
+
+func TestWarm(t *testing.T) {
+	s := newDigestServer("auth")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	r := New(context.Background(), "john", "hello", WithBaseURL(ts.URL))
+	if err := r.Warm(context.Background(), "/"); err != nil {
+		t.Fatalf("error in Warm: %v", err)
+	}
+	if n := s.requests(); n != 1 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	// the first request answers the challenge kept
+	if err := doGet(r, ts.URL); err != nil {
+		t.Fatalf("error in doGet: %v", err)
+	}
+	if n := s.requests(); n != 2 {
+		t.Errorf("invalid number of requests: %d", n)
+	}
+	if nc := s.lastAuthorization()["nc"]; nc != "00000001" {
+		t.Errorf("invalid nc: %s", nc)
+	}
+
+	open := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer open.Close()
+	if err := r.Warm(context.Background(), open.URL); err != ErrNoChallenge {
+		t.Errorf("invalid error for an open server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.Warm(ctx, "/"); err != context.Canceled {
+		t.Errorf("invalid error for a cancelled context: %v", err)
+	}
+}
+
+func TestWarmPreparesProbe(t *testing.T) {
+	s := newDigestServer("auth")
+	var probe http.Header
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probe = r.Header
+		s.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+	u.User = url.UserPassword("john", "hello")
+	r := New(context.Background(), "", "", WithUserAgent("agent/1.0"), WithHeader("X-Api", "2"))
+	if err := r.Warm(context.Background(), u.String()); err != nil {
+		t.Fatalf("error in Warm: %v", err)
+	}
+	if a := probe.Get(authorization); a != "" {
+		t.Errorf("userinfo is sent: %s", a)
+	}
+	if ua := probe.Get(userAgent); ua != "agent/1.0" {
+		t.Errorf("invalid User-Agent: %s", ua)
+	}
+	if v := probe.Get("X-Api"); v != "2" {
+		t.Errorf("invalid X-Api: %s", v)
+	}
+	if err := doGet(r, u.String()); err != nil || s.requests() != 2 {
+		t.Errorf("error after %d requests: %v", s.requests(), err)
+	}
+}
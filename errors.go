@@ -0,0 +1,132 @@
+package digestRequest
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrInvalidResponseAuth is returned by Do when the rspauth of the server in
+// Authentication-Info does not match, so the response cannot be trusted to
+// come from a server knowing the password
+var ErrInvalidResponseAuth = errors.New("digest authentication: invalid rspauth from server")
+
+// ResponseAuthError is returned by Do with WithStrictAuthenticationInfo when
+// the Authentication-Info of the server echoes a directive other than it was
+// sent
+type ResponseAuthError struct {
+	// Directive is the name of the directive, qop, cnonce or nc
+	Directive string
+	// Sent and Received are the values as they are, but a cnonce is redacted
+	// from the message
+	Sent     string
+	Received string
+}
+
+func (e *ResponseAuthError) Error() string {
+	sent, received := e.Sent, e.Received
+	if e.Directive == cnonce {
+		sent, received = redact(sent), redact(received)
+	}
+	return fmt.Sprintf("digest authentication: %s in Authentication-Info is %q instead of %q", e.Directive, received, sent)
+}
+
+// Is makes errors.Is(err, ErrInvalidResponseAuth) true
+func (e *ResponseAuthError) Is(target error) bool {
+	return target == ErrInvalidResponseAuth
+}
+
+// ErrBodyTooLarge is returned by Do when a request body without GetBody
+// would have to be buffered beyond WithMaxBodyBuffer
+var ErrBodyTooLarge = errors.New("digest authentication: request body too large to buffer")
+
+// ErrNonceExhausted is returned by Do when the server hands out a nonce
+// which was sent with the last nc, ffffffff, already. A cached nonce is
+// probed for anew before that.
+var ErrNonceExhausted = errors.New("digest authentication: nonce count exhausted")
+
+// ErrMissingRealm is returned by Do when the server sends a challenge with
+// everything but the realm, which the credentials are hashed with. See
+// WithDefaultRealm.
+var ErrMissingRealm = errors.New("digest authentication: header is invalid: missing required directives: [realm]")
+
+// ErrNoChallenge is returned by CheckAuth and Warm when the server answers
+// without asking for authentication, so there is nothing to answer
+var ErrNoChallenge = errors.New("digest authentication: server does not ask for authentication")
+
+// ErrForbidden is what a *ForbiddenError is, for errors.Is
+var ErrForbidden = errors.New("digest authentication: forbidden")
+
+// ForbiddenError is returned by Do with WithForbiddenError when the server
+// accepts the credentials but answers 403, so they lack the rights for the
+// request, as opposed to a *RetryError for wrong ones. The caller must close
+// the body of Response.
+type ForbiddenError struct {
+	Response *http.Response
+}
+
+func (e *ForbiddenError) Error() string {
+	return "digest authentication: forbidden: " + e.Response.Status
+}
+
+// Is makes errors.Is(err, ErrForbidden) true
+func (e *ForbiddenError) Is(target error) bool {
+	return target == ErrForbidden
+}
+
+// RejectedError is returned by CheckAuth when the server rejects the
+// credentials without a new challenge to retry with
+type RejectedError struct {
+	Status     string
+	StatusCode int
+}
+
+func (e *RejectedError) Error() string {
+	return "digest authentication: credentials rejected: " + e.Status
+}
+
+// RetryError is returned by Do when the server keeps rejecting the
+// authenticated request after all retries are used up
+type RetryError struct {
+	// Retries is the number of retries after genuine rejections
+	Retries int
+	// StaleRetries is the number of retries after stale=true rejections
+	StaleRetries int
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("digest authentication failed after %d retries (%d stale)", e.Retries, e.StaleRetries)
+}
+
+// ChallengeError is returned by Do when the challenge of the probe cannot be
+// answered, with the status line and headers of the rejection, whose body
+// is closed. Err is the reason, e.g. a *SchemeError or ErrMissingRealm, for
+// errors.As and errors.Is.
+type ChallengeError struct {
+	Err        error
+	Status     string
+	StatusCode int
+	Header     http.Header
+	// Body is the start of the body kept by WithRejectionBody, or nil
+	Body []byte
+}
+
+func (e *ChallengeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ChallengeError) Unwrap() error {
+	return e.Err
+}
+
+// SchemeError is returned by Do when the server asks for authentication
+// with other schemes only, such as Basic or NTLM, which tells a server not
+// doing Digest from a malformed Digest challenge
+type SchemeError struct {
+	Schemes []string
+}
+
+func (e *SchemeError) Error() string {
+	return fmt.Sprintf("server offers %s but not Digest", strings.Join(e.Schemes, ", "))
+}
@@ -0,0 +1,57 @@
+//go:build go1.18
+// +build go1.18
+
+package digestRequest
+
+import (
+	"net/http"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// FuzzParseChallenge makes sure that no challenge header crashes the parser
+// or the Authorization made from what it accepts. Run it with
+//
+//	go test -fuzz FuzzParseChallenge
+func FuzzParseChallenge(f *testing.F) {
+	for _, header := range []string{
+		// RFC 2617
+		`Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+		// RFC 7616
+		`Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v", opaque="FQhe/qaU925kfnzjCev0ciny7QMkPqMAFRtzCUYo5tdS"`,
+		// Apache mod_auth_digest
+		`Digest realm="private", nonce="kJ7yKgNVBQA=6c2a1f8e3d0e6e3b5f0b2f2f1b9b8d0e7a6c5b4a", algorithm=MD5, domain="/private/ http://example.com/other/", qop="auth"`,
+		// IIS
+		`Digest qop=auth,algorithm=MD5-sess,nonce="+Upgraded+v1d5e4f0a4c8e3d2",charset=utf-8,realm="Digest"`,
+		// Dahua cameras
+		`Digest realm="Login to 4M0A2E9PAZ1234", qop="auth", nonce="1234567890", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+		// stale nonces and escapes
+		`Digest realm="a\"b", nonce="n\\1", opaque="o", qop="auth", stale=TRUE`,
+		`Basic realm="a", Digest realm="b", nonce="n", opaque="o", qop="auth"`,
+		"\ufeffDigest realm=\"x\", nonce=\"y\", opaque=\"z\", qop=\"auth\"",
+		`Digest realm="unterminated, nonce="`,
+		`Digest ,,,==,"`,
+		`Digest`,
+		``,
+	} {
+		f.Add(header)
+	}
+
+	f.Fuzz(func(t *testing.T, header string) {
+		r := New(context.Background(), "john", "hello")
+		resp := &http.Response{Header: http.Header{wwwAuthenticate: {header}}}
+		c, err := r.parseChallenge(resp)
+		if err != nil {
+			return
+		}
+		if err := c.validate(); err != nil {
+			t.Errorf("invalid challenge is accepted: %v", err)
+		}
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatalf("error in NewRequest: %v", err)
+		}
+		_, _, _ = r.makeAuthorization(req, c, "00000001", credentials{"john", "hello"})
+	})
+}
@@ -0,0 +1,392 @@
+package digestRequest
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Option configures a DigestRequest
+type Option func(*DigestRequest)
+
+// WithPreferredQop makes the client answer with qop when the server offers
+// it, e.g. "auth-int" to protect the entity-body as well.
+//
+// auth-int hashes the body before sending it. Set req.GetBody for large
+// uploads so that the body is streamed twice instead of buffered in memory.
+func WithPreferredQop(qop string) Option {
+	return func(r *DigestRequest) {
+		r.preferredQop = qop
+	}
+}
+
+// WithStrictQop makes requests fail when the server does not offer the qop
+// given by WithPreferredQop instead of falling back to another one
+func WithStrictQop() Option {
+	return func(r *DigestRequest) {
+		r.strictQop = true
+	}
+}
+
+// WithMaxRetries sets how many times Do retries when the server rejects the
+// authenticated request without stale=true. It defaults to 1 and 0 disables
+// retrying.
+func WithMaxRetries(n int) Option {
+	return func(r *DigestRequest) {
+		r.maxRetries = n
+	}
+}
+
+// WithIISCompat works around Microsoft IIS, which only accepts the uri
+// directive in the form of the request-target, such as "/dir/index.html",
+// instead of the absolute URL
+func WithIISCompat() Option {
+	return func(r *DigestRequest) {
+		r.originFormURI = true
+	}
+}
+
+// WithChallengeHeader sets the header the challenge is read from instead of
+// Www-Authenticate, e.g. "Proxy-Authenticate" or "X-WWW-Authenticate"
+func WithChallengeHeader(name string) Option {
+	return func(r *DigestRequest) {
+		r.challengeHeader = http.CanonicalHeaderKey(name)
+	}
+}
+
+// WithAuthorizationHeader sets the header the credentials are sent in
+// instead of Authorization, e.g. "Proxy-Authorization"
+func WithAuthorizationHeader(name string) Option {
+	return func(r *DigestRequest) {
+		r.authorizationHeader = http.CanonicalHeaderKey(name)
+	}
+}
+
+// WithChallengeInterceptor sets a function to inspect or fix the challenge,
+// e.g. to supply an opaque the server forgot, before it is answered. It is a
+// last resort for broken servers.
+func WithChallengeInterceptor(f func(*Challenge)) Option {
+	return func(r *DigestRequest) {
+		r.interceptor = f
+	}
+}
+
+// WithResponseFunc computes the response directive with f instead of
+// Response, for vendors which compute it in their own way, e.g. with an
+// extra field. Like WithChallengeInterceptor, it is a last resort for
+// broken servers.
+func WithResponseFunc(f func(ResponseInput) string) Option {
+	return func(r *DigestRequest) {
+		r.respond = f
+	}
+}
+
+// WithRandom makes cnonces from random instead of crypto/rand, e.g. a
+// seeded math/rand.Rand to make the Authorization of a test reproducible.
+// Never use a predictable source against a real server.
+func WithRandom(random io.Reader) Option {
+	return func(r *DigestRequest) {
+		r.random = random
+	}
+}
+
+// WithDirectiveOrder puts the named directives, such as "username" or
+// "response", first in the Authorization header in the given order, for
+// servers that parse it by position. The others follow in the default order:
+// username, realm, nonce, uri, qop, nc, cnonce, response, opaque, algorithm,
+// userhash.
+func WithDirectiveOrder(names ...string) Option {
+	return func(r *DigestRequest) {
+		r.directiveOrder = names
+	}
+}
+
+// WithUnquotedURI sends the uri directive without quotes, as required by
+// some noncompliant servers
+func WithUnquotedURI() Option {
+	return func(r *DigestRequest) {
+		r.unquotedURI = true
+	}
+}
+
+// WithQuotedNC sends the nc directive in quotes, as in nc="00000001", for
+// noncompliant servers which require it to be quoted
+func WithQuotedNC() Option {
+	return func(r *DigestRequest) {
+		r.quotedNC = true
+	}
+}
+
+// WithUppercaseNC sends the nc directive in uppercase hex, as in
+// nc=0000000A, for noncompliant servers which require it
+func WithUppercaseNC() Option {
+	return func(r *DigestRequest) {
+		r.uppercaseNC = true
+	}
+}
+
+// WithAllowedAlgorithms refuses challenges with any other algorithm than
+// those given. MD5, which a challenge without an algorithm asks for too, is
+// weak and only used when it is listed. Without this option every supported
+// algorithm is accepted.
+func WithAllowedAlgorithms(algorithms ...string) Option {
+	return func(r *DigestRequest) {
+		r.allowedAlgorithms = append([]string{}, algorithms...)
+	}
+}
+
+// WithNonceLifetime makes Do probe for a new nonce instead of using one the
+// server handed out longer than d ago, for servers known to expire nonces
+// after d. A probe that gets the same nonce again starts its age over.
+// Nonces that expire earlier are still renewed by retrying after the
+// stale=true rejection.
+func WithNonceLifetime(d time.Duration) Option {
+	return func(r *DigestRequest) {
+		r.nonceLifetime = d
+	}
+}
+
+// WithReprobeEvery makes Do probe for a new challenge after n requests in a
+// row reused the one of the cache, to stay ahead of servers with short
+// nonce lifetimes without waiting for the stale=true rejection. Zero, the
+// default, never probes again while the nonce is accepted.
+func WithReprobeEvery(n int) Option {
+	return func(r *DigestRequest) {
+		r.reprobeEvery = n
+	}
+}
+
+// WithMaskedUsername makes String show only the first letter of the username
+func WithMaskedUsername() Option {
+	return func(r *DigestRequest) {
+		r.maskUsername = true
+	}
+}
+
+// WithDisableCompression keeps the transport from asking for gzip and
+// decoding it, as http.Transport.DisableCompression does. Responses then
+// keep their Content-Encoding and compressed body. By default gzip is
+// decoded transparently, as long as the request does not set
+// Accept-Encoding itself.
+func WithDisableCompression() Option {
+	return func(r *DigestRequest) {
+		r.disableCompression = true
+	}
+}
+
+// WithRetry retries requests answered with 429, 502, 503 or 504 up to count
+// times, waiting backoff before the first retry and twice as long before
+// each one after. A Retry-After of the server is waited for instead, up to
+// a minute, including one on the rejection of the probe. The probe is always
+// retried, but authenticated requests only when their method is idempotent
+// or WithNonIdempotentRetries is given. It is separate from WithMaxRetries,
+// which is about rejected authentication.
+func WithRetry(count int, backoff time.Duration) Option {
+	return func(r *DigestRequest) {
+		r.retries = count
+		r.backoff = backoff
+	}
+}
+
+// WithNonIdempotentRetries lets Do retry requests with methods that are not
+// idempotent, such as POST and PATCH, after rejections and transient
+// errors. Use it only when the server is known not to act on a request it
+// rejects, or the request is safe to repeat.
+func WithNonIdempotentRetries() Option {
+	return func(r *DigestRequest) {
+		r.nonIdempotentRetries = true
+	}
+}
+
+// AuthMode tells when requests carry an Authorization, see WithAuthMode
+type AuthMode int
+
+const (
+	// AuthProbeFirst probes for the challenge before the first request to an
+	// origin, and answers it with the following ones. It is the default.
+	AuthProbeFirst AuthMode = iota
+	// AuthPreemptive answers a known challenge with the first request to an
+	// origin instead of probing, and the challenge of a rejection as
+	// AuthProbeFirst does
+	AuthPreemptive
+	// AuthPreemptiveOnly neither probes nor answers rejections: the first
+	// request to an origin answers a known challenge, or is sent as it is
+	// when there is none, and a rejection is returned as it is. Its challenge
+	// is answered by the next request.
+	AuthPreemptiveOnly
+)
+
+// WithAuthMode sets when requests carry an Authorization, for servers which
+// fail requests without one, or with one they did not ask for. c is the
+// challenge the preemptive modes answer for an origin with no challenge yet,
+// and may be nil. DoPreauthorized is AuthPreemptive for a single request.
+func WithAuthMode(mode AuthMode, c *Challenge) Option {
+	return func(r *DigestRequest) {
+		r.authMode = mode
+		r.preemptive = c
+	}
+}
+
+// WithStrictAuthenticationInfo makes Do check the qop, cnonce and nc which
+// the server echoes in Authentication-Info against those sent, besides the
+// rspauth, and fail with a *ResponseAuthError when one differs. Directives
+// the server leaves out are not checked.
+func WithStrictAuthenticationInfo() Option {
+	return func(r *DigestRequest) {
+		r.strictAuthInfo = true
+	}
+}
+
+// WithForbiddenError makes Do return a *ForbiddenError for a 403 to an
+// authenticated request, to tell valid credentials without the rights for
+// it from wrong ones
+func WithForbiddenError() Option {
+	return func(r *DigestRequest) {
+		r.forbiddenError = true
+	}
+}
+
+// WithAuthStatusCodes sets the status codes of responses which carry a
+// challenge to answer, for gateways which send it with another one. The
+// default is 401, or 407 with WithChallengeHeader("Proxy-Authenticate"), so
+// for proxy authentication use
+//
+//	WithChallengeHeader("Proxy-Authenticate"),
+//	WithAuthorizationHeader("Proxy-Authorization")
+//
+// A challenge in a response with any other status is ignored.
+func WithAuthStatusCodes(codes ...int) Option {
+	return func(r *DigestRequest) {
+		r.authStatusCodes = append([]int{}, codes...)
+	}
+}
+
+// WithExpectedRealm makes requests fail before any credentials are sent
+// when the server asks for another realm than realm
+func WithExpectedRealm(realm string) Option {
+	return func(r *DigestRequest) {
+		r.expectedRealm = realm
+	}
+}
+
+// WithDefaultRealm answers challenges without a realm, from servers which
+// leave it out, as if they had sent realm. Without it, such a challenge
+// fails with ErrMissingRealm.
+func WithDefaultRealm(realm string) Option {
+	return func(r *DigestRequest) {
+		r.defaultRealm = realm
+	}
+}
+
+// WithCredentialProvider looks up the credentials for the realm of each
+// challenge instead of using those given to New. When the server offers
+// challenges for several realms, the first one provide has credentials for
+// is answered, and requests fail when it has none for any of them. It is
+// asked for every request, so a server that changes its realm gets the
+// credentials for the new one.
+func WithCredentialProvider(provide func(realm string) (username, password string, ok bool)) Option {
+	return func(r *DigestRequest) {
+		r.credentialProvider = provide
+	}
+}
+
+// WithRoundTripper makes the probe and the authenticated requests go through
+// rt, e.g. tracing or logging middleware, instead of the transport made
+// here. The timeouts of that transport and WithDisableCompression do not
+// apply then; rt is in charge of them.
+func WithRoundTripper(rt http.RoundTripper) Option {
+	return func(r *DigestRequest) {
+		r.roundTripper = rt
+	}
+}
+
+// WithBaseURL sets the URL which relative URLs given to Get, Head, Post and
+// CheckAuth are appended to, as in "https://example.com/api" and
+// "/v1/status". Absolute URLs are requested as they are.
+func WithBaseURL(base string) Option {
+	return func(r *DigestRequest) {
+		r.baseURL = base
+	}
+}
+
+// WithPinnedPublicKeys makes requests connect only to servers with one of
+// pins in their verified certificate chain, so that credentials cannot go to
+// another server with a valid certificate. A pin is the base64 of the
+// SHA-256 of the SubjectPublicKeyInfo, as in RFC 7469. It applies to an
+// *http.Transport given to WithRoundTripper too, which is copied; with any
+// other round tripper, requests fail with ErrPinningUnsupported.
+func WithPinnedPublicKeys(pins ...string) Option {
+	return func(r *DigestRequest) {
+		r.pins = append([]string{}, pins...)
+	}
+}
+
+// WithUserAgent sets the User-Agent of requests which have none, and so of
+// their probes too. The probe always has the User-Agent of its request.
+func WithUserAgent(ua string) Option {
+	return func(r *DigestRequest) {
+		r.userAgent = ua
+	}
+}
+
+// WithHeader sets the header name to value on requests which do not have
+// it, and so on their probes too. It can be given more than once, also for
+// the same name to set several values.
+func WithHeader(name, value string) Option {
+	return func(r *DigestRequest) {
+		if r.headers == nil {
+			r.headers = make(http.Header)
+		}
+		r.headers.Add(name, value)
+	}
+}
+
+// WithReadWriteTimeout sets the deadline of connections, counted from when
+// they are opened, instead of 2.5 seconds. Zero sets none, for long polling
+// and event streams; bound those by the request context instead.
+func WithReadWriteTimeout(d time.Duration) Option {
+	return func(r *DigestRequest) {
+		r.readWriteTimeout = d
+	}
+}
+
+// WithProbeMethod sends the probe for the challenge with method, such as
+// HEAD or OPTIONS, instead of the method of the request, for servers which
+// act on a POST before rejecting it. The authenticated request still has
+// its own method, which is what the response is computed with. CONNECT is
+// always probed with CONNECT.
+func WithProbeMethod(method string) Option {
+	return func(r *DigestRequest) {
+		r.probeMethod = method
+	}
+}
+
+// WithProbeBody sends the body with the probe too, for servers which only
+// challenge requests after seeing their body. The body is buffered in
+// memory unless req.GetBody is set, and is uploaded twice, so it costs as
+// much bandwidth again.
+func WithProbeBody() Option {
+	return func(r *DigestRequest) {
+		r.probeBody = true
+	}
+}
+
+// WithRejectionBody keeps up to n bytes of the body of the rejection of the
+// probe, which some servers explain lockouts or rate limits in. It is in the
+// Body of LastChallenge, or of the *ChallengeError returned when the
+// challenge cannot be answered.
+func WithRejectionBody(n int64) Option {
+	return func(r *DigestRequest) {
+		r.rejectionBody = n
+	}
+}
+
+// WithMaxBodyBuffer limits the request bodies buffered in memory to n bytes.
+// A body without GetBody is buffered to be sent again after the challenge,
+// or to be hashed for auth-int; Do returns ErrBodyTooLarge instead for one
+// over n. Set GetBody for larger bodies, which are then streamed.
+func WithMaxBodyBuffer(n int64) Option {
+	return func(r *DigestRequest) {
+		r.maxBodyBuffer = n
+	}
+}
@@ -0,0 +1,74 @@
+package digestRequest
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// ErrUnpinnedCertificate is returned by Do when the certificates of the
+// server carry none of the keys given to WithPinnedPublicKeys
+var ErrUnpinnedCertificate = errors.New("digest authentication: server certificate is not pinned")
+
+// publicKeyPin returns the pin of the key of cert, which is the base64 of
+// the SHA-256 of its SubjectPublicKeyInfo as in RFC 7469
+func publicKeyPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ErrPinningUnsupported is returned by Do when WithPinnedPublicKeys is
+// given with a round tripper which is not an *http.Transport, whose TLS
+// connections cannot be checked
+var ErrPinningUnsupported = errors.New("digest authentication: public keys cannot be pinned with this round tripper")
+
+// verifyPins returns the VerifyConnection which accepts a connection when a
+// certificate of a verified chain has one of pins, after next accepts it if
+// it is set. Without verified chains, as with InsecureSkipVerify, only the
+// leaf is looked at, since the rest of what the server sends proves nothing.
+//
+// VerifyConnection runs on resumed sessions too, which VerifyPeerCertificate
+// does not.
+func verifyPins(pins []string, next func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if next != nil {
+			if err := next(cs); err != nil {
+				return err
+			}
+		}
+		var certs []*x509.Certificate
+		for _, chain := range cs.VerifiedChains {
+			certs = append(certs, chain...)
+		}
+		if len(cs.VerifiedChains) == 0 && len(cs.PeerCertificates) > 0 {
+			certs = append(certs, cs.PeerCertificates[0])
+		}
+		for _, cert := range certs {
+			if contains(pins, publicKeyPin(cert)) {
+				return nil
+			}
+		}
+		return ErrUnpinnedCertificate
+	}
+}
+
+// pinTransport returns a copy of client which only connects to servers
+// with one of pins. The transport is copied, since it may be the caller's,
+// and only an *http.Transport can be pinned.
+func pinTransport(client *http.Client, pins []string) (*http.Client, error) {
+	t, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return nil, ErrPinningUnsupported
+	}
+	t = t.Clone()
+	if t.TLSClientConfig == nil {
+		t.TLSClientConfig = &tls.Config{}
+	}
+	t.TLSClientConfig.VerifyConnection = verifyPins(pins, t.TLSClientConfig.VerifyConnection)
+	c := *client
+	c.Transport = t
+	return &c, nil
+}
@@ -0,0 +1,96 @@
+package digestRequest
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// maxRedirects is the number of redirects followed, as in http.Client
+const maxRedirects = 10
+
+// redirectDropped are the headers a redirect to another host goes without
+var redirectDropped = []string{"Authorization", "Www-Authenticate", "Cookie", "Cookie2", "Proxy-Authorization"}
+
+// redirectRequest makes the request to follow the redirect in resp to, in
+// the same way as http.Client. It returns nil when resp is not a redirect.
+func (r *DigestRequest) redirectRequest(req *http.Request, resp *http.Response) (*http.Request, error) {
+	method := req.Method
+	body := false
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		if method != http.MethodGet && method != http.MethodHead {
+			method = http.MethodGet
+		}
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		body = true
+	default:
+		return nil, nil
+	}
+
+	loc, err := resp.Location()
+	if err == http.ErrNoLocation {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	next, err := http.NewRequest(method, loc.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	next = next.WithContext(req.Context())
+	for k, v := range req.Header {
+		next.Header[k] = append([]string(nil), v...)
+	}
+	next.Header.Del(r.authorizationHeader)
+	// as net/http does, credentials of any kind stay on the host they were
+	// given for
+	if !strings.EqualFold(next.URL.Host, req.URL.Host) {
+		for _, k := range redirectDropped {
+			next.Header.Del(k)
+		}
+	}
+	if body && req.GetBody != nil {
+		if next.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+		next.GetBody = req.GetBody
+		next.ContentLength = req.ContentLength
+	}
+	return next, nil
+}
+
+// covers tells whether u is in the protection space of c, which was sent in
+// reply to a request for origin
+func (c *Challenge) covers(origin, u *url.URL) bool {
+	if len(c.Domain) == 0 {
+		return sameOrigin(origin, u)
+	}
+	for _, d := range c.Domain {
+		du, err := origin.Parse(d)
+		if err != nil {
+			continue
+		}
+		if sameOrigin(du, u) && strings.HasPrefix(u.Path, du.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+func sameOrigin(a, b *url.URL) bool {
+	return strings.EqualFold(httpScheme(a.Scheme), httpScheme(b.Scheme)) && strings.EqualFold(a.Host, b.Host)
+}
+
+// httpScheme returns the scheme of the HTTP requests which WebSocket
+// connections of scheme are upgraded from, so that they share a session
+func httpScheme(scheme string) string {
+	switch strings.ToLower(scheme) {
+	case "ws":
+		return "http"
+	case "wss":
+		return "https"
+	}
+	return scheme
+}
@@ -0,0 +1,109 @@
+package digestRequest
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// retryable tells whether resp is a transient failure which WithRetry
+// retries
+func retryable(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// maxConnRetries bounds the retries of a probe whose connection broke
+// before a response was read, and connRetryDelay is the wait before the
+// first of them, doubled for each one after
+const maxConnRetries = 2
+const connRetryDelay = 50 * time.Millisecond
+
+// connBroken tells whether err is the connection being reset or closed by
+// the server before a response was read, which a resend may get past. A
+// response, a 401 included, is never such an error.
+func connBroken(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// maxRetryAfter bounds the wait a server can ask for with Retry-After
+const maxRetryAfter = time.Minute
+
+// retryAfter returns the wait asked for by the Retry-After of resp, in
+// seconds or as a date, up to maxRetryAfter
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	v := resp.Header.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	var d time.Duration
+	if secs, err := strconv.Atoi(v); err == nil {
+		d = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(v); err == nil {
+		d = time.Until(t)
+	} else {
+		return 0, false
+	}
+	if d < 0 {
+		d = 0
+	}
+	if d > maxRetryAfter {
+		d = maxRetryAfter
+	}
+	return d, true
+}
+
+// wait sleeps for d, or returns the error of ctx when it ends first
+func wait(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// idempotent tells whether requests with method can be sent again safely,
+// as in RFC 7231
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// mayResend tells whether req may be sent again automatically, which for
+// methods that are not idempotent needs WithNonIdempotentRetries
+func (r *DigestRequest) mayResend(req *http.Request) bool {
+	return idempotent(req.Method) || r.nonIdempotentRetries
+}
+
+// shouldRetry tells whether the attempt-th try that got resp is retried, and
+// waits if so, as long as Retry-After asks or else for the backoff, which
+// doubles with every attempt. An error is returned when the context ends
+// while waiting.
+func (r *DigestRequest) shouldRetry(ctx context.Context, resp *http.Response, attempt int) (bool, error) {
+	if attempt >= r.retries || !retryable(resp) {
+		return false, nil
+	}
+	discardBody(resp)
+	d, ok := retryAfter(resp)
+	if !ok {
+		d = r.backoff << uint(attempt)
+	}
+	if err := wait(ctx, d); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,212 @@
+package digestRequest
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// digestServer is a minimal digest authentication server for tests which
+// offers a configurable challenge and records what clients send to it
+type digestServer struct {
+	realm, nonce, opaque, qop string
+	domain                    string
+	username, password        string
+	// algorithm is sent in the challenge and hashed with when it is set
+	algorithm string
+
+	challengeHeader, authorizationHeader string
+	// status is the status code of rejections, 401 unless it is set
+	status int
+
+	// rawChallenge replaces the generated challenge when it is set
+	rawChallenge string
+	// accept adds a condition for a request to be authorized
+	accept func(r *http.Request, params map[string]string) bool
+	// nextNonce makes the server hand out a new nonce in Authentication-Info
+	// with every authorized response, and reject the old one
+	nextNonce bool
+	// rspauth makes the server send an rspauth in Authentication-Info,
+	// computed from the correct one
+	rspauth func(correct string) string
+	// authInfo adds directives to Authentication-Info, given the ones of the
+	// request
+	authInfo func(params map[string]string) []string
+	// authorized serves authorized requests instead of answering "OK"
+	authorized http.HandlerFunc
+	// beforeCheck is called with the directives of every request before
+	// they are verified
+	beforeCheck func(params map[string]string)
+
+	mu             sync.Mutex
+	staleNonces    map[string]bool
+	authorizations []map[string]string
+	bodies         []string
+}
+
+func newDigestServer(qop string) *digestServer {
+	return &digestServer{
+		realm:       "example.com",
+		nonce:       "dcd98b7102dd2f0e8b11d0f600bfb0c093",
+		opaque:      "5ccc069c403ebaf9f0171e9517f40e41",
+		qop:         qop,
+		username:    "john",
+		password:    "hello",
+		staleNonces: make(map[string]bool),
+
+		challengeHeader:     wwwAuthenticate,
+		authorizationHeader: authorization,
+	}
+}
+
+// rotateNonce replaces the nonce. Requests with the old one are answered
+// with stale=true when stale is set, or rejected plainly otherwise.
+func (s *digestServer) rotateNonce(stale bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.staleNonces[s.nonce] = stale
+	s.nonce = h(s.nonce)
+}
+
+func (s *digestServer) challenge(stale bool) string {
+	if s.rawChallenge != "" {
+		return s.rawChallenge
+	}
+	c := fmt.Sprintf(`Digest realm="%s", nonce="%s", opaque="%s"`, s.realm, s.nonce, s.opaque)
+	if s.qop != "" {
+		c += fmt.Sprintf(`, qop="%s"`, s.qop)
+	}
+	if s.domain != "" {
+		c += fmt.Sprintf(`, domain="%s"`, s.domain)
+	}
+	if s.algorithm != "" {
+		c += ", algorithm=" + s.algorithm
+	}
+	if stale {
+		c += ", stale=true"
+	}
+	return c
+}
+
+var authParamRegexp = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+func parseAuthorization(header string) map[string]string {
+	if !strings.HasPrefix(header, "Digest ") {
+		return nil
+	}
+	params := make(map[string]string)
+	for _, m := range authParamRegexp.FindAllStringSubmatch(header, -1) {
+		params[m[1]] = m[2] + m[3]
+	}
+	return params
+}
+
+func h(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// hash is h with the algorithm of s
+func (s *digestServer) hash(text string) string {
+	switch strings.ToUpper(s.algorithm) {
+	case "SHA-256":
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:])
+	case "SHA-512-256":
+		sum := sha512.Sum512_256([]byte(text))
+		return hex.EncodeToString(sum[:])
+	}
+	return h(text)
+}
+
+func (s *digestServer) expectedResponse(method string, params map[string]string, body []byte) string {
+	ha1 := s.hash(s.username + ":" + s.realm + ":" + s.password)
+	ha2 := s.hash(method + ":" + params["uri"])
+	if params["qop"] == "auth-int" {
+		ha2 = s.hash(method + ":" + params["uri"] + ":" + s.hash(string(body)))
+	}
+	if params["qop"] == "" {
+		return s.hash(strings.Join([]string{ha1, params["nonce"], ha2}, ":"))
+	}
+	return s.hash(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+}
+
+func (s *digestServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := parseAuthorization(r.Header.Get(s.authorizationHeader))
+	if params != nil && s.beforeCheck != nil {
+		s.beforeCheck(params)
+	}
+
+	s.mu.Lock()
+	s.authorizations = append(s.authorizations, params)
+	current := params != nil && params["nonce"] == s.nonce
+	stale := params != nil && s.staleNonces[params["nonce"]]
+	s.mu.Unlock()
+
+	// the body is read only for a current nonce, so that a client waiting
+	// for 100 Continue is rejected before sending it
+	var body []byte
+	if current {
+		body, _ = ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.bodies = append(s.bodies, string(body))
+		s.mu.Unlock()
+	}
+
+	if !current || params["response"] != s.expectedResponse(r.Method, params, body) ||
+		s.accept != nil && !s.accept(r, params) {
+		s.mu.Lock()
+		w.Header().Add(s.challengeHeader, s.challenge(stale))
+		s.mu.Unlock()
+		status := http.StatusUnauthorized
+		if s.status != 0 {
+			status = s.status
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	var info []string
+	if s.rspauth != nil {
+		// rspauth is the response with an empty method
+		correct := s.expectedResponse("", params, nil)
+		info = append(info, fmt.Sprintf(`rspauth="%s"`, s.rspauth(correct)))
+	}
+	if s.authInfo != nil {
+		info = append(info, s.authInfo(params)...)
+	}
+	if s.nextNonce {
+		s.rotateNonce(false)
+		s.mu.Lock()
+		info = append(info, fmt.Sprintf(`nextnonce="%s"`, s.nonce))
+		s.mu.Unlock()
+	}
+	if len(info) > 0 {
+		w.Header().Set(authenticationInfo, strings.Join(info, ", "))
+	}
+	if s.authorized != nil {
+		s.authorized(w, r)
+		return
+	}
+	fmt.Fprintf(w, "OK")
+}
+
+// lastAuthorization returns the directives of the last request received
+func (s *digestServer) lastAuthorization() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.authorizations[len(s.authorizations)-1]
+}
+
+// requests returns the number of requests received
+func (s *digestServer) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.authorizations)
+}
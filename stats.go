@@ -0,0 +1,59 @@
+package digestRequest
+
+// Stats describes the last call to Do
+type Stats struct {
+	// RoundTrips is the number of requests sent: 1 when a nonce answered
+	// before is reused, 2 with the probe, and one more for every retry and
+	// redirect followed
+	RoundTrips int
+	// Authenticated tells whether the response returned was to a request
+	// with an Authorization. It is false when the server did not ask for
+	// one, which may mean it is misconfigured.
+	Authenticated bool
+}
+
+// Stats returns the stats of the last call to Do or RoundTrip. With several
+// calls at once, it is the one which finished last.
+func (r *DigestRequest) Stats() Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// LastChallenge returns a copy of the challenge answered last, or nil if
+// there has been none
+func (r *DigestRequest) LastChallenge() *Challenge {
+	s := r.sessions.lastUsed()
+	if s == nil {
+		return nil
+	}
+	c := *s.current()
+	return &c
+}
+
+// HostState is the state of authentication with a host
+type HostState struct {
+	Realm string
+	Nonce string
+	// NC is the nonce count sent last with Nonce
+	NC string
+}
+
+// HostStats returns a snapshot of the state of authentication with every
+// host a challenge has been answered for, by origin such as
+// "https://example.com". For a host with several realms, it is the state of
+// the one answered last.
+func (r *DigestRequest) HostStats() map[string]HostState {
+	hosts := r.sessions.hosts()
+	stats := make(map[string]HostState, len(hosts))
+	for key, s := range hosts {
+		s.mu.Lock()
+		stats[key] = HostState{
+			Realm: s.challenge.Realm,
+			Nonce: s.challenge.Nonce,
+			NC:    s.nonceCount.String(),
+		}
+		s.mu.Unlock()
+	}
+	return stats
+}